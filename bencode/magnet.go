@@ -1,9 +1,11 @@
 package bencode
 
 import (
+	"encoding/base32"
 	"encoding/hex"
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -31,8 +33,14 @@ func ParseMagnetLink(magnetURI string) (*MagnetMetadata, error) {
 		return nil, fmt.Errorf("missing or invalid xt parameter")
 	}
 
-	infoHashHex := strings.TrimPrefix(xt, "urn:btih:")
-	infoHash, err := hex.DecodeString(infoHashHex)
+	encoded := strings.TrimPrefix(xt, "urn:btih:")
+	var infoHash []byte
+	if len(encoded) == 32 {
+		// Older clients write the hash in base32
+		infoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	} else {
+		infoHash, err = hex.DecodeString(encoded)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("invalid info hash: %v", err)
 	}
@@ -40,11 +48,43 @@ func ParseMagnetLink(magnetURI string) (*MagnetMetadata, error) {
 	trackers := params["tr"]
 	udpTrackers := ExtractUDPTrackers(trackers)
 
+	selectOnly, err := ParseSelectOnly(params.Get("so"))
+	if err != nil {
+		return nil, err
+	}
+
 	metadata := &MagnetMetadata{
 		InfoHash:    infoHash,
 		DisplayName: params.Get("dn"),
 		UDPTrackers: udpTrackers,
+		SelectOnly:  selectOnly,
 	}
 
 	return metadata, nil
 }
+
+// ParseSelectOnly parses a BEP 53 "so" value such as "0,2,4-6" into ranges.
+// They are not expanded, since only the torrent knows how many files exist.
+func ParseSelectOnly(value string) ([]SelectRange, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var ranges []SelectRange
+	for _, part := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid so parameter %q", value)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid so parameter %q", value)
+			}
+		}
+		ranges = append(ranges, SelectRange{First: start, Last: end})
+	}
+	return ranges, nil
+}
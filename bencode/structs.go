@@ -15,6 +15,7 @@ type Torrent struct {
 	Info         InfoDictionary
 	InfoHash     string
 	TotalSize    int64
+	Raw          []byte // the encoded file, written out as is to save it
 }
 
 // InfoDictionary represents the `info` section of a torrent file
@@ -57,6 +58,12 @@ type MagnetMetadata struct {
 	InfoHash    []byte
 	DisplayName string
 	UDPTrackers []string
+	SelectOnly  []SelectRange // BEP 53 file ranges, empty selects every file
+}
+
+// SelectRange is an inclusive range of file indices from a BEP 53 "so" value
+type SelectRange struct {
+	First, Last int
 }
 
 // Protocol constants as defined in BEP 15 (will be used for connecting to peers using the trackers, will be implemented later)
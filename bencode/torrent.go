@@ -51,15 +51,22 @@ func ParseTorrentFile(filename string) (Torrent, error) {
 	if err != nil {
 		return Torrent{}, err
 	}
+	return ParseTorrent(data)
+}
 
+// ParseTorrent parses the contents of a .torrent file and calculates the info hash
+func ParseTorrent(data []byte) (Torrent, error) {
 	decoder := NewBencodeDecoder(data)
 	torrentDict, err := decoder.Decode()
 	if err != nil {
 		return Torrent{}, err
 	}
 
-	torrent := Torrent{}
-	root := torrentDict.(map[string]interface{})
+	root, ok := torrentDict.(map[string]interface{})
+	if !ok {
+		return Torrent{}, fmt.Errorf("torrent is not a bencoded dictionary")
+	}
+	torrent := Torrent{Raw: data}
 
 	if announce, ok := root["announce"].(string); ok {
 		torrent.Announce = announce
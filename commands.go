@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	bencode "github.com/serene-brew/ztorrent/bencode"
+	config "github.com/serene-brew/ztorrent/config"
+	interfaces "github.com/serene-brew/ztorrent/interfaces"
+	mag "github.com/serene-brew/ztorrent/torrent"
+)
+
+// commands maps subcommand names to their handlers, given the loaded
+// configuration and the arguments after the subcommand name
+var commands = map[string]func(conf config.Config, args []string) error{
+	"seed":           runSeed,
+	"magnet2torrent": runMagnet2Torrent,
+	"tui":            runTUI,
+}
+
+// runTUI opens the session and drives it from the terminal UI until the user quits
+//
+//	ztorrent tui
+func runTUI(conf config.Config, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: ztorrent tui")
+	}
+
+	session, err := mag.NewSession(conf.Session, conf.DownloadPath)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	for _, err := range session.RestoreErrors() {
+		fmt.Println("Warning:", err)
+	}
+
+	interfaces.AttachSession(session)
+	return interfaces.Run()
+}
+
+// runSeed verifies existing data against a .torrent and seeds it until
+// interrupted or its seed goal is reached. The session keeps its state in a
+// temporary directory, so torrents saved by other runs are not restarted.
+//
+//	ztorrent seed <file.torrent> <data dir>
+func runSeed(conf config.Config, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: ztorrent seed <file.torrent> <data dir>")
+	}
+
+	stateDir, err := os.MkdirTemp("", "ztorrent-seed-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stateDir)
+
+	sessionConf := conf.Session
+	sessionConf.Seed = true
+	sessionConf.StateDir = stateDir
+	// Watch folders would add unrelated torrents to this session
+	sessionConf.WatchDirs = nil
+	session, err := mag.NewSession(sessionConf, conf.DownloadPath)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	goal := session.Subscribe(mag.EventFilter{Types: []mag.EventType{mag.EventSeedGoal}}, 1)
+	defer goal.Close()
+
+	fmt.Printf("Verifying %s against %s...\n", args[0], args[1])
+	h, err := session.AddTorrentWithData(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Seeding %s from %s\n", h.Name(), h.SavePath())
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-interrupt:
+			fmt.Println()
+			return nil
+		case e, ok := <-goal.Events():
+			if !ok {
+				return nil
+			}
+			if e, ok := e.(mag.SeedGoalEvent); ok && e.InfoHash == h.InfoHash() {
+				fmt.Printf("\nSeed goal reached: %s\n", e.Reason)
+				return nil
+			}
+		case <-ticker.C:
+			p := h.Progress()
+			fmt.Printf("\r%d peers | up %s/s | uploaded %s | ratio %.2f   ",
+				len(h.Torrent().PeerConns()),
+				mag.HumanReadableSize(int64(p.Rates.Upload)),
+				mag.HumanReadableSize(h.Uploaded()),
+				h.Ratio())
+			if err := h.Err(); err != nil {
+				fmt.Println()
+				return err
+			}
+		}
+	}
+}
+
+// runMagnet2Torrent resolves magnet links and writes their .torrent files
+//
+//	ztorrent magnet2torrent [-timeout 2m] [-tracker url]... [-o path] <magnet>
+//	ztorrent magnet2torrent [-timeout 2m] [-jobs 4] [-o dir] -batch <file>
+func runMagnet2Torrent(conf config.Config, args []string) error {
+	fs := flag.NewFlagSet("magnet2torrent", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", 2*time.Minute, "how long to wait for the metadata of each magnet")
+	out := fs.String("o", ".", "output directory, or file name for a single magnet")
+	batch := fs.String("batch", "", "file with one magnet per line")
+	jobs := fs.Int("jobs", 4, "magnets fetched at once in batch mode")
+	var trackers stringList
+	fs.Var(&trackers, "tracker", "extra tracker added to every magnet, may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var magnets []string
+	switch {
+	case *batch != "" && fs.NArg() == 0:
+		list, err := readMagnets(*batch)
+		if err != nil {
+			return err
+		}
+		magnets = dedupeMagnets(list)
+	case *batch == "" && fs.NArg() == 1:
+		magnets = fs.Args()
+	default:
+		return fmt.Errorf("usage: ztorrent magnet2torrent [flags] <magnet> | -batch <file>")
+	}
+	if *jobs < 1 {
+		*jobs = 1
+	}
+
+	fetcher, err := mag.NewMetadataFetcher(conf.Session)
+	if err != nil {
+		return err
+	}
+	defer fetcher.Close()
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	queue := make(chan string)
+	for i := 0; i < *jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for magnet := range queue {
+				path, err := saveMagnet(fetcher, magnet, trackers, *out, *batch == "", *timeout)
+				mu.Lock()
+				if err != nil {
+					failed++
+					fmt.Printf("FAIL %s: %v\n", magnet, err)
+				} else {
+					fmt.Printf("OK   %s\n", path)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, magnet := range magnets {
+		queue <- magnet
+	}
+	close(queue)
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d magnets failed", failed, len(magnets))
+	}
+	return nil
+}
+
+// saveMagnet fetches the metadata of one magnet and writes it under out,
+// which names the file itself when single is set and it ends in .torrent.
+// Without single the file name carries the info hash, so torrents of the
+// same name do not overwrite each other.
+func saveMagnet(fetcher *mag.MetadataFetcher, magnet string, trackers []string, out string, single bool, timeout time.Duration) (string, error) {
+	magnet, err := withTrackers(magnet, trackers)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	t, err := fetcher.Fetch(ctx, magnet)
+	if err != nil {
+		return "", err
+	}
+
+	path := out
+	if !single || !strings.HasSuffix(out, ".torrent") {
+		name := strings.NewReplacer("/", "_", "\\", "_").Replace(t.Info.Name)
+		switch {
+		case name == "" || name == "." || name == "..":
+			name = t.InfoHash
+		case !single:
+			// Different torrents often share a name
+			name += "." + t.InfoHash
+		}
+		path = filepath.Join(out, name+".torrent")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, t.Raw, 0644); err != nil {
+		return "", fmt.Errorf("failed to write torrent file: %v", err)
+	}
+	return path, nil
+}
+
+// withTrackers appends tracker URLs to a magnet link as tr parameters
+func withTrackers(magnet string, trackers []string) (string, error) {
+	if len(trackers) == 0 {
+		return magnet, nil
+	}
+	u, err := url.Parse(magnet)
+	if err != nil || u.Scheme != "magnet" {
+		return "", fmt.Errorf("invalid magnet link %q", magnet)
+	}
+	q := u.Query()
+	for _, tr := range trackers {
+		q.Add("tr", tr)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// readMagnets reads one magnet per line, skipping blank lines and # comments
+func readMagnets(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read magnets: %v", err)
+	}
+	var magnets []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		magnets = append(magnets, line)
+	}
+	if len(magnets) == 0 {
+		return nil, fmt.Errorf("no magnets in %s", path)
+	}
+	return magnets, nil
+}
+
+// dedupeMagnets drops magnets whose info hash appeared earlier in the list,
+// since fetches of the same hash share one torrent. Magnets that do not
+// parse are kept so they are reported as failures.
+func dedupeMagnets(magnets []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, magnet := range magnets {
+		if m, err := bencode.ParseMagnetLink(magnet); err == nil {
+			hash := hex.EncodeToString(m.InfoHash)
+			if seen[hash] {
+				fmt.Printf("SKIP %s: duplicate info hash %s\n", magnet, hash)
+				continue
+			}
+			seen[hash] = true
+		}
+		unique = append(unique, magnet)
+	}
+	return unique
+}
+
+// stringList is a flag that collects every value it is given
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
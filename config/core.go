@@ -0,0 +1,206 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+const envPrefix = "ZTORRENT_"
+
+// DefaultPath returns $XDG_CONFIG_HOME/ztorrent/config
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot locate config directory: %v", err)
+	}
+	return filepath.Join(dir, "ztorrent", "config"), nil
+}
+
+// Load builds the configuration from defaults, the config file, ZTORRENT_*
+// environment variables and command line flags, each layer overriding the
+// previous one. The file path comes from -config, $ZTORRENT_CONFIG or
+// DefaultPath. Non-flag arguments are returned untouched.
+func Load(args []string) (*Store, []string, error) {
+	keys := settableKeys()
+
+	fs := flag.NewFlagSet("ztorrent", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configPath := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "path to the config file")
+	flagValues := make(map[string]string)
+	for _, k := range keys {
+		fs.Var(&recordingValue{key: k.key, bool: k.isBool, values: flagValues}, k.key, k.key)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	path := *configPath
+	if path == "" {
+		var err error
+		if path, err = DefaultPath(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	file, err := readFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &Store{
+		path:      path,
+		file:      file,
+		current:   file,
+		overrides: make(map[string]string),
+	}
+	// Slices are shared between layers unless copied
+	s.current.Trackers = append([]string(nil), file.Trackers...)
+
+	for _, k := range keys {
+		if v, ok := os.LookupEnv(envName(k.key)); ok {
+			s.overrides[k.key] = v
+		}
+	}
+	for k, v := range flagValues {
+		s.overrides[k] = v
+	}
+	for k, v := range s.overrides {
+		if err := setKey(&s.current, k, v); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := s.current.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return s, fs.Args(), nil
+}
+
+// readFile loads path on top of Default, a missing file is not an error
+func readFile(path string) (Config, error) {
+	conf := Default()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return conf, nil
+	}
+	if err != nil {
+		return conf, fmt.Errorf("failed to read config %s: %v", path, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&conf); err != nil {
+		return conf, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+	return conf, nil
+}
+
+// Config returns the effective configuration with every layer applied
+func (s *Store) Config() Config {
+	return s.current
+}
+
+// Path returns the config file location
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Set changes a setting by its dotted key, e.g. "session.listen_port", as a
+// settings UI would. The change replaces any environment or flag override
+// and is persisted on the next Save.
+func (s *Store) Set(key, value string) error {
+	next := s.file
+	next.Trackers = append([]string(nil), s.file.Trackers...)
+	if err := setKey(&next, key, value); err != nil {
+		return err
+	}
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	if err := setKey(&s.current, key, value); err != nil {
+		return err
+	}
+	s.file = next
+	delete(s.overrides, key)
+	return nil
+}
+
+// Update replaces the file layer wholesale, for settings screens that edit a copy of Config
+func (s *Store) Update(conf Config) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	s.file = conf
+	s.current = conf
+	for k, v := range s.overrides {
+		if err := setKey(&s.current, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save atomically writes the file layer back to disk
+func (s *Store) Save() error {
+	data, err := json.MarshalIndent(s.file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".config-*")
+	if err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	return nil
+}
+
+// Validate reports the first invalid setting in any section
+func (c Config) Validate() error {
+	if c.DownloadPath == "" {
+		return fmt.Errorf("download_path cannot be empty")
+	}
+	if err := c.Session.Validate(); err != nil {
+		return fmt.Errorf("session: %v", err)
+	}
+	if err := c.Crawler.Validate(); err != nil {
+		return fmt.Errorf("crawler: %v", err)
+	}
+	for _, tr := range c.Trackers {
+		u, err := url.Parse(tr)
+		if err != nil {
+			return fmt.Errorf("trackers: %q is not a valid url", tr)
+		}
+		switch u.Scheme {
+		case "udp", "http", "https", "ws", "wss":
+		default:
+			return fmt.Errorf("trackers: %q has unsupported scheme %q", tr, u.Scheme)
+		}
+	}
+	if err := c.Theme.Validate(); err != nil {
+		return fmt.Errorf("theme: %v", err)
+	}
+	return nil
+}
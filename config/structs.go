@@ -0,0 +1,36 @@
+package config
+
+import (
+	crawler "github.com/serene-brew/ztorrent/crawler"
+	interfaces "github.com/serene-brew/ztorrent/interfaces"
+	mag "github.com/serene-brew/ztorrent/torrent"
+)
+
+// Config is the full persisted ztorrent configuration
+type Config struct {
+	DownloadPath string           `json:"download_path"`
+	Session      mag.Config       `json:"session"`
+	Crawler      crawler.Config   `json:"crawler"`
+	Trackers     []string         `json:"trackers"`
+	Theme        interfaces.Theme `json:"theme"`
+}
+
+// Default returns the configuration used when no file exists
+func Default() Config {
+	return Config{
+		DownloadPath: mag.GetDefaultDownloadPath(),
+		Session:      mag.DefaultConfig(),
+		Crawler:      crawler.DefaultConfig(),
+		Trackers:     crawler.DefaultTrackers(),
+		Theme:        interfaces.DefaultTheme(),
+	}
+}
+
+// Store keeps the file layer apart from environment and flag overrides so
+// that Save only ever writes what came from the file or the settings UI
+type Store struct {
+	path      string
+	file      Config
+	current   Config
+	overrides map[string]string
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// keyInfo describes one setting addressable by env and flags
+type keyInfo struct {
+	key    string
+	isBool bool
+}
+
+// settableKeys lists every scalar or string list field of Config by its dotted json path
+func settableKeys() []keyInfo {
+	var keys []keyInfo
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := jsonName(f)
+			if name == "" {
+				continue
+			}
+			key := prefix + name
+			switch {
+			case f.Type.Kind() == reflect.Struct:
+				walk(f.Type, key+".")
+			case isSettable(f.Type):
+				keys = append(keys, keyInfo{key: key, isBool: f.Type.Kind() == reflect.Bool})
+			}
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "")
+	return keys
+}
+
+func jsonName(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	tag := strings.Split(f.Tag.Get("json"), ",")[0]
+	if tag == "-" || tag == "" {
+		return ""
+	}
+	return tag
+}
+
+func isSettable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+// envName maps "session.listen_port" to ZTORRENT_SESSION_LISTEN_PORT
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// setKey parses raw into the field of c addressed by key
+func setKey(c *Config, key, raw string) error {
+	v := reflect.ValueOf(c).Elem()
+	for _, part := range strings.Split(key, ".") {
+		if v.Kind() != reflect.Struct {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			if jsonName(v.Type().Field(i)) == part {
+				v = v.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	if !isSettable(v.Type()) {
+		return fmt.Errorf("setting %q cannot be set from a string", key)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a boolean", key, raw)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not an integer", key, raw)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", key, raw)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list).Convert(v.Type()))
+	}
+	return nil
+}
+
+// recordingValue is a flag.Value that stores raw flag text for later layering
+type recordingValue struct {
+	key    string
+	bool   bool
+	values map[string]string
+}
+
+func (r *recordingValue) String() string {
+	if r == nil || r.values == nil {
+		return ""
+	}
+	return r.values[r.key]
+}
+
+func (r *recordingValue) Set(s string) error {
+	r.values[r.key] = s
+	return nil
+}
+
+func (r *recordingValue) IsBoolFlag() bool {
+	return r.bool
+}
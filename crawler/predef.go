@@ -1,13 +1,114 @@
 package crawler
 
 import (
+	"fmt"
+	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+
+	"github.com/serene-brew/ztorrent/proxy"
+)
+
+// Provider is an apibay compatible search endpoint
+type Provider struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Config controls how the crawler talks to search providers
+type Config struct {
+	Providers      []Provider `json:"providers"` // tried in order until one answers
+	UserAgent      string     `json:"user_agent"`
+	TimeoutSeconds int        `json:"timeout_seconds"`
+}
+
+// DefaultConfig returns the built in provider list
+func DefaultConfig() Config {
+	return Config{
+		Providers: []Provider{
+			{Name: "apibay", URL: "https://apibay.org"},
+		},
+		UserAgent:      "Mozilla/5.0 (X11; Linux x86_64; rv:99.0) Gecko/20100101 Firefox/99.0",
+		TimeoutSeconds: 30,
+	}
+}
+
+// Validate reports the first unusable crawler setting
+func (c Config) Validate() error {
+	if len(c.Providers) == 0 {
+		return fmt.Errorf("at least one crawler provider is required")
+	}
+	for _, p := range c.Providers {
+		u, err := url.Parse(p.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("crawler provider %q has invalid url %q", p.Name, p.URL)
+		}
+	}
+	if c.TimeoutSeconds < 0 {
+		return fmt.Errorf("crawler timeout_seconds cannot be negative")
+	}
+	return nil
+}
+
+var (
+	settingsMu sync.RWMutex
+	settings   = DefaultConfig()
 )
 
-var URLencodedTrackers []string
+// Configure replaces the crawler settings used by later queries
+func Configure(c Config) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings = c
+}
+
+// SetProxy routes provider requests through p when its crawler switch is on
+func SetProxy(p proxy.Config) error {
+	var transport http.RoundTripper
+	if p.ForCrawler() {
+		t, err := p.Transport()
+		if err != nil {
+			return fmt.Errorf("crawler proxy: %w", err)
+		}
+		transport = t
+	}
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	proxyTransport = transport
+	return nil
+}
+
+// proxyTransport carries provider requests when a proxy is set, nil dials directly
+var proxyTransport http.RoundTripper
+
+func currentSettings() Config {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return settings
+}
+
+func currentTransport() http.RoundTripper {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return proxyTransport
+}
+
+// DefaultTrackers returns the built in tracker list
+func DefaultTrackers() []string {
+	return append([]string(nil), defaultTrackers...)
+}
+
+// SetTrackers replaces the trackers appended to generated magnet links
+func SetTrackers(list []string) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	trackers = append([]string(nil), list...)
+}
+
+var trackers = DefaultTrackers()
 
-var trackers = [...]string{
+var defaultTrackers = []string{
 	"http://104.28.1.30:8080/announce",
 	"http://104.28.16.69/announce",
 	"http://107.150.14.110:6969/announce",
@@ -28,7 +129,7 @@ var trackers = [...]string{
 	"udp://tracker.openbittorrent.com:6969/announce",
 	"udp://public.popcorn-tracker.org:6969/announce",
 	"udp://9.rarbg.to:2710/announce",
-	"upd://9.rarbg.me:2780/announce",
+	"udp://9.rarbg.me:2780/announce",
 	"udp://9.rarbg.to:2730/announce",
 	"udp://tracker.coppersurfer.tk:6969/announce",
 	"udp://tracker.opentrackr.org:1337",
@@ -47,10 +148,14 @@ var category = [...]string{
 	"other",
 }
 
+// GenTrackerStub returns the configured trackers URL encoded and joined for
+// the tr parameters of a magnet link
 func GenTrackerStub() string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	encoded := make([]string, 0, len(trackers))
 	for _, tracker := range trackers {
-		encodedTracker := url.QueryEscape(tracker)
-		URLencodedTrackers = append(URLencodedTrackers, encodedTracker)
+		encoded = append(encoded, url.QueryEscape(tracker))
 	}
-	return strings.Join(URLencodedTrackers, "&tr=")
+	return strings.Join(encoded, "&tr=")
 }
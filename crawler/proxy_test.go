@@ -0,0 +1,58 @@
+package crawler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/serene-brew/ztorrent/proxy"
+	"github.com/serene-brew/ztorrent/proxy/proxytest"
+)
+
+func TestProviderRequestsUseProxy(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"1","name":"found","info_hash":"00","seeders":"1","leechers":"0"}]`))
+	}))
+	defer provider.Close()
+	socks := proxytest.NewServer()
+	defer socks.Close()
+
+	conf := DefaultConfig()
+	conf.Providers = []Provider{{Name: "test", URL: provider.URL}}
+	Configure(conf)
+	defer Configure(DefaultConfig())
+
+	tests := []struct {
+		name    string
+		proxy   proxy.Config
+		proxied bool
+	}{
+		{"crawler switch", proxy.Config{URL: socks.URL, Crawler: true}, true},
+		{"proxy only", proxy.Config{URL: socks.URL, Only: true}, true},
+		{"peers only", proxy.Config{URL: socks.URL, Peers: true}, false},
+	}
+	defer SetProxy(proxy.Config{})
+
+	host := strings.TrimPrefix(provider.URL, "http://")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(socks.Dials())
+			if err := SetProxy(tt.proxy); err != nil {
+				t.Fatal(err)
+			}
+			result, err := GetInfoMediaQuery("anything")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result) != 1 || result[0][1] != "found" {
+				t.Fatalf("unexpected result %v", result)
+			}
+			dials := socks.Dials()[before:]
+			proxied := len(dials) > 0 && dials[0] == host
+			if proxied != tt.proxied {
+				t.Errorf("proxied %v, want %v (dials %v)", proxied, tt.proxied, dials)
+			}
+		})
+	}
+}
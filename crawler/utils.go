@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Torrent struct {
@@ -26,17 +28,35 @@ type Torrent struct {
 }
 
 func GetInfoMediaQuery(query string) ([][]interface{}, error) {
-	agent := "Mozilla/5.0 (X11; Linux x86_64; rv:99.0) Gecko/20100101 Firefox/99.0"
+	conf := currentSettings()
+	var lastErr error
+	for _, provider := range conf.Providers {
+		result, err := queryProvider(conf, provider, query)
+		if err == nil {
+			return result, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", provider.Name, err)
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no crawler providers configured")
+	}
+	return nil, lastErr
+}
+
+func queryProvider(conf Config, provider Provider, query string) ([][]interface{}, error) {
 	encodedQuery := url.QueryEscape(query)
-	apiURL := fmt.Sprintf("https://apibay.org/q.php?q=%s", encodedQuery)
+	apiURL := fmt.Sprintf("%s/q.php?q=%s", strings.TrimSuffix(provider.URL, "/"), encodedQuery)
 
-	client := &http.Client{}
+	client := &http.Client{
+		Timeout:   time.Duration(conf.TimeoutSeconds) * time.Second,
+		Transport: currentTransport(),
+	}
 	req, err := http.NewRequest("GET", apiURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %w", err)
 	}
 
-	req.Header.Set("User-Agent", agent)
+	req.Header.Set("User-Agent", conf.UserAgent)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -67,9 +87,7 @@ func GetInfoMediaQuery(query string) ([][]interface{}, error) {
 func ClassifyCategory(categoryID string) string {
 	category_ID_string := string(categoryID[0])
 	category_ID, _ := strconv.Atoi(category_ID_string)
-	if category_ID < len(category)-1 {
-		category_ID = category_ID
-	} else {
+	if category_ID >= len(category)-1 {
 		category_ID = 6
 	}
 
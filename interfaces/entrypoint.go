@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/list"
 	"github.com/charmbracelet/bubbles/table"
 	"github.com/charmbracelet/bubbles/textinput"
@@ -30,7 +31,7 @@ type model struct {
 }
 
 func (m model) Init() tea.Cmd {
-	return nil
+	return statusTick()
 }
 
 func (m model) View() string {
@@ -39,11 +40,11 @@ func (m model) View() string {
 		if m.quitting {
 			return quitTextStyle.Render(m.magnet)
 		}
-		return "\n" + m.list.View()
+		return "\n" + m.list.View() + "\n" + statusBar()
 	case CrawlerScreen:
 		inputS := m.styles.inputBorder.Render(m.input.View())
 		tableS := m.styles.tableBorder.Render(m.table.View())
-		return lipgloss.JoinVertical(lipgloss.Top, inputS, tableS)
+		return lipgloss.JoinVertical(lipgloss.Top, inputS, tableS, statusBar())
 	}
 	return ""
 }
@@ -67,6 +68,9 @@ func ListModel() model {
 	l.Styles.Title = titleStyle
 	l.Styles.PaginationStyle = paginationStyle
 	l.Styles.HelpStyle = helpStyle
+	l.AdditionalShortHelpKeys = func() []key.Binding {
+		return []key.Binding{altSpeedKey}
+	}
 
 	columns := []table.Column{
 		{Title: "Sl.No", Width: 5},
@@ -102,9 +106,14 @@ func ListModel() model {
 }
 
 func Entrypoint() {
-	m := ListModel()
-	if _, err := tea.NewProgram(m).Run(); err != nil {
+	if err := Run(); err != nil {
 		fmt.Println("Error running program:", err)
 		os.Exit(1)
 	}
 }
+
+// Run starts the TUI and returns once the user quits
+func Run() error {
+	_, err := tea.NewProgram(ListModel()).Run()
+	return err
+}
@@ -15,6 +15,9 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.list.SetWidth(msg.Width)
 		return m, nil
 
+	case statusTickMsg:
+		return m, statusTick()
+
 	case tea.KeyMsg:
 		switch m.currentScreen {
 		case ListScreen:
@@ -23,6 +26,13 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.quitting = true
 				return m, tea.Quit
 
+			case "a":
+				// Toggle alt speed limits, shown in the status bar
+				if session != nil {
+					session.ToggleAltSpeed()
+				}
+				return m, nil
+
 			case "enter":
 				i, ok := m.list.SelectedItem().(item)
 				if ok {
@@ -0,0 +1,73 @@
+package interfaces
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	tea "github.com/charmbracelet/bubbletea"
+	gloss "github.com/charmbracelet/lipgloss"
+	mag "github.com/serene-brew/ztorrent/torrent"
+)
+
+// session is the torrent session driven by the TUI, nil until attached
+var session *mag.Session
+
+// AttachSession hands the TUI the session its controls act on, it must be
+// called before the program starts
+func AttachSession(s *mag.Session) {
+	session = s
+}
+
+// statusTickMsg redraws the status bar, which changes without user input
+type statusTickMsg struct{}
+
+// statusTick schedules the next status bar refresh while a session is attached
+func statusTick() tea.Cmd {
+	if session == nil {
+		return nil
+	}
+	return tea.Tick(time.Second, func(time.Time) tea.Msg { return statusTickMsg{} })
+}
+
+var altSpeedKey = key.NewBinding(key.WithKeys("a"), key.WithHelp("a", "alt speed"))
+
+var statusStyle = gloss.NewStyle().MarginLeft(2).Faint(true)
+
+// statusBar summarises the session state shown under every screen
+func statusBar() string {
+	if session == nil {
+		return ""
+	}
+
+	var parts []string
+	limits := session.Limits()
+	if session.AltSpeed() {
+		parts = append(parts, "alt speed")
+	} else if profile := session.Profile(); profile != "" {
+		parts = append(parts, "profile "+profile)
+	}
+	parts = append(parts,
+		"down "+formatLimit(limits.Download),
+		"up "+formatLimit(limits.Upload),
+	)
+	if iface := session.Interface(); iface.Name != "" {
+		if iface.Up {
+			parts = append(parts, "iface "+iface.Name+" up")
+		} else {
+			parts = append(parts, fmt.Sprintf("iface %s down for %s, torrents held", iface.Name, time.Since(iface.Since).Round(time.Second)))
+		}
+	}
+	if stats := session.BlocklistStats(); stats.Source != "" {
+		parts = append(parts, fmt.Sprintf("blocklist %d ranges, %d blocked", stats.Ranges, stats.Blocked))
+	}
+	return statusStyle.Render(strings.Join(parts, " | "))
+}
+
+func formatLimit(bps int64) string {
+	if bps <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%s/s", mag.HumanReadableSize(bps))
+}
@@ -1,6 +1,10 @@
 package interfaces
 
 import (
+	"fmt"
+	"regexp"
+	"strconv"
+
 	"github.com/charmbracelet/bubbles/list"
 	"github.com/charmbracelet/bubbles/table"
 	gloss "github.com/charmbracelet/lipgloss"
@@ -15,6 +19,57 @@ var (
 	quitTextStyle     = gloss.NewStyle().Margin(1, 0, 2, 4)
 )
 
+// Theme holds the colours used across the TUI, as ANSI 256 codes or #rrggbb
+type Theme struct {
+	Accent     string `json:"accent"`
+	Active     string `json:"active"`
+	Inactive   string `json:"inactive"`
+	SelectedFg string `json:"selected_fg"`
+	SelectedBg string `json:"selected_bg"`
+}
+
+// DefaultTheme returns the stock colour scheme
+func DefaultTheme() Theme {
+	return Theme{
+		Accent:     "170",
+		Active:     "93",
+		Inactive:   "8",
+		SelectedFg: "229",
+		SelectedBg: "57",
+	}
+}
+
+var hexColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Validate reports the first colour that lipgloss cannot render
+func (t Theme) Validate() error {
+	colors := map[string]string{
+		"accent":      t.Accent,
+		"active":      t.Active,
+		"inactive":    t.Inactive,
+		"selected_fg": t.SelectedFg,
+		"selected_bg": t.SelectedBg,
+	}
+	for name, c := range colors {
+		if hexColor.MatchString(c) {
+			continue
+		}
+		if n, err := strconv.Atoi(c); err == nil && n >= 0 && n <= 255 {
+			continue
+		}
+		return fmt.Errorf("theme %s %q is neither an ANSI code 0-255 nor #rrggbb", name, c)
+	}
+	return nil
+}
+
+var theme = DefaultTheme()
+
+// ApplyTheme switches the TUI colours, it must be called before the program starts
+func ApplyTheme(t Theme) {
+	theme = t
+	selectedItemStyle = selectedItemStyle.Foreground(gloss.Color(t.Accent))
+}
+
 type Crawlerstyles struct {
 	list1Border   gloss.Style
 	list2Border   gloss.Style
@@ -28,14 +83,14 @@ func CrawlerStyles() Crawlerstyles {
 	return Crawlerstyles{
 		inputBorder: gloss.NewStyle().
 			Border(gloss.RoundedBorder()).
-			BorderForeground(gloss.Color("93")).
+			BorderForeground(gloss.Color(theme.Active)).
 			Padding(1),
 		tableBorder: gloss.NewStyle().
 			Border(gloss.RoundedBorder()).
-			BorderForeground(gloss.Color("8")).
+			BorderForeground(gloss.Color(theme.Inactive)).
 			Padding(1),
-		activeColor:   "93",
-		inactiveColor: "8",
+		activeColor:   theme.Active,
+		inactiveColor: theme.Inactive,
 	}
 }
 
@@ -43,13 +98,13 @@ func getTableStyles() table.Styles {
 	s := table.DefaultStyles()
 	s.Header = s.Header.
 		BorderStyle(gloss.NormalBorder()).
-		BorderForeground(gloss.Color("8")).
+		BorderForeground(gloss.Color(theme.Inactive)).
 		BorderBottom(true).
 		Bold(false)
 
 	s.Selected = s.Selected.
-		Foreground(gloss.Color("229")).
-		Background(gloss.Color("57")).
+		Foreground(gloss.Color(theme.SelectedFg)).
+		Background(gloss.Color(theme.SelectedBg)).
 		Bold(true)
 
 	return s
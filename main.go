@@ -9,9 +9,10 @@ import (
 
 	// local package imports
 	bencode "github.com/serene-brew/ztorrent/bencode"
+	config "github.com/serene-brew/ztorrent/config"
 	crawler "github.com/serene-brew/ztorrent/crawler"
+	interfaces "github.com/serene-brew/ztorrent/interfaces"
 	mag "github.com/serene-brew/ztorrent/torrent"
-	// interfaces "github.com/serene-brew/ztorrent/interfaces"
 )
 
 // main serves as a test harness for the torrent functionality for now
@@ -23,6 +24,36 @@ import (
 // Note: This will be replaced with a TUI interface in the final version
 // the TUI entrypoint will be coded later into main.go
 func main() {
+	// SECTION 0: Configuration
+	// Layer the config file, ZTORRENT_* environment variables and flags
+	store, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+	conf := store.Config()
+	crawler.Configure(conf.Crawler)
+	crawler.SetTrackers(conf.Trackers)
+	if err := crawler.SetProxy(conf.Session.Proxy); err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+	interfaces.ApplyTheme(conf.Theme)
+
+	// Subcommands such as `ztorrent seed` run instead of the harness below
+	if len(args) > 0 {
+		run, ok := commands[args[0]]
+		if !ok {
+			fmt.Println("Unknown command:", args[0])
+			os.Exit(2)
+		}
+		if err := run(conf, args[1:]); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// SECTION 1: Torrent File Processing
 	// Parse a local torrent file to extract metadata
 	torrent, err := bencode.ParseTorrentFile("example.torrent")
@@ -40,7 +71,7 @@ func main() {
 
 	// SECTION 2: Peer Discovery
 	// Get peer information from the torrent file
-	torInfo, peers, err := mag.GetPeersFromFile("example.torrent")
+	torInfo, peers, err := mag.GetPeersFromFile(conf.Session, "example.torrent")
 	if err != nil {
 		fmt.Println("Error getting peers:", err)
 		os.Exit(1)
@@ -104,7 +135,7 @@ func main() {
 
 	// SECTION 4: Download Process
 	// Get peer information from magnet link
-	torInfo, peers, err = mag.GetPeers(magnet) // core.go line 64 GetPeers function
+	torInfo, peers, err = mag.GetPeers(conf.Session, magnet) // core.go line 64 GetPeers function
 	if err != nil {
 		fmt.Println("Error getting peers:", err)
 		os.Exit(1)
@@ -120,11 +151,11 @@ func main() {
 	// Start download process
 	fmt.Printf("\nStarting download...\n")
 
-	// Set custom download path in user's home directory
-	customPath := filepath.Join(mag.GetDefaultDownloadPath(), "torrents") // core.go line 10 GetDefaultDownloadPath function
+	// Set custom download path under the configured download directory
+	customPath := filepath.Join(conf.DownloadPath, "torrents")
 
 	// Initialize download and get progress channel
-	progress, err := mag.DownloadFromMagnet(magnet, customPath) // for default path, keep second parameter as ""
+	progress, err := mag.DownloadFromMagnet(conf.Session, magnet, customPath) // for default path, keep second parameter as ""
 	if err != nil {
 		fmt.Println("Error starting download:", err)
 		os.Exit(1)
@@ -135,6 +166,10 @@ func main() {
 
 	// Monitor and display download progress
 	for p := range progress {
+		if p.Err != nil {
+			fmt.Println("\nError downloading:", p.Err)
+			os.Exit(1)
+		}
 		fmt.Printf("\r[%s] %.1f%% %.1f MB/s ETA: %s",
 			getProgressBar(p.Percentage),
 			p.Percentage,
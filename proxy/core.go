@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// DialFunc opens a connection like net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Validate reports a proxy URL that cannot be used
+func (c Config) Validate() error {
+	if c.URL == "" {
+		if c.Only {
+			return fmt.Errorf("proxy only mode needs a proxy url")
+		}
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy url: %v", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return fmt.Errorf("proxy url scheme must be socks5 or http, got %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("proxy url %q has no host", c.URL)
+	}
+	return nil
+}
+
+// ForPeers reports whether peer connections go through the proxy
+func (c Config) ForPeers() bool {
+	return c.URL != "" && (c.Peers || c.Only)
+}
+
+// ForTrackers reports whether tracker and web seed requests go through the proxy
+func (c Config) ForTrackers() bool {
+	return c.URL != "" && (c.Trackers || c.Only)
+}
+
+// ForCrawler reports whether search requests go through the proxy
+func (c Config) ForCrawler() bool {
+	return c.URL != "" && (c.Crawler || c.Only)
+}
+
+// Dialer returns a function connecting through the proxy. Host names it is
+// given are resolved by the proxy, callers that look names up before
+// dialing still leak those lookups.
+func (c Config) Dialer() (DialFunc, error) {
+	return c.DialerVia(nil)
+}
+
+// DialerVia is Dialer reaching the proxy itself with forward, nil dials directly
+func (c Config) DialerVia(forward DialFunc) (DialFunc, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(c.URL)
+	if forward == nil {
+		d := &net.Dialer{Timeout: 30 * time.Second}
+		forward = d.DialContext
+	}
+
+	if u.Scheme == "http" {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialConnect(ctx, forward, u, addr)
+		}, nil
+	}
+
+	var auth *xproxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &xproxy.Auth{User: u.User.Username(), Password: password}
+	}
+	d, err := xproxy.SOCKS5("tcp", u.Host, auth, forward)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SOCKS5 dialer: %v", err)
+	}
+	return d.(xproxy.ContextDialer).DialContext, nil
+}
+
+// Transport returns an HTTP transport sending every request through the proxy
+func (c Config) Transport() (*http.Transport, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(c.URL)
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if u.Scheme == "http" {
+		t.Proxy = http.ProxyURL(u)
+		return t, nil
+	}
+	dial, err := c.Dialer()
+	if err != nil {
+		return nil, err
+	}
+	t.Proxy = nil
+	t.DialContext = dial
+	return t, nil
+}
+
+// HTTPClient returns a client using the proxy when use is set and a
+// direct one otherwise
+func (c Config) HTTPClient(use bool, timeout time.Duration) (*http.Client, error) {
+	if !use {
+		return &http.Client{Timeout: timeout}, nil
+	}
+	t, err := c.Transport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Timeout: timeout, Transport: t}, nil
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request
+func dialConnect(ctx context.Context, forward DialFunc, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := forward(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused tunnel to %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The peer spoke first, keep what was read past the response
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// DialContext lets a DialFunc stand in for a net.Dialer
+func (f DialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// Dial is DialContext without a context
+func (f DialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
@@ -0,0 +1,195 @@
+// Package proxytest runs a SOCKS5 proxy in process, so tests can check which
+// connections go through a proxy
+package proxytest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Server is a SOCKS5 proxy without authentication that records the target
+// of every CONNECT it serves
+type Server struct {
+	// URL is socks5://host:port of the listener
+	URL string
+
+	l     net.Listener
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	dials []string
+	conns map[net.Conn]bool
+	hosts map[string]string
+}
+
+// NewServer starts a proxy on a loopback port. It panics when no port can
+// be opened, like httptest.NewServer.
+func NewServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("proxytest: failed to listen: %v", err))
+	}
+	s := &Server{
+		URL:   "socks5://" + l.Addr().String(),
+		l:     l,
+		conns: make(map[net.Conn]bool),
+		hosts: make(map[string]string),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Alias makes the proxy connect to ip when asked for the host name, so tests
+// can use names that do not resolve
+func (s *Server) Alias(name, ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hosts[name] = ip
+}
+
+// Dials returns the host:port targets requested so far, in order
+func (s *Server) Dials() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.dials...)
+}
+
+// Dialed reports whether a connection to addr went through the proxy
+func (s *Server) Dialed(addr string) bool {
+	for _, d := range s.Dials() {
+		if d == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops the listener and every tunnel it opened
+func (s *Server) Close() {
+	s.l.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.track(c, true)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.track(c, false)
+			s.handle(c)
+		}()
+	}
+}
+
+func (s *Server) track(c net.Conn, open bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if open {
+		s.conns[c] = true
+	} else {
+		delete(s.conns, c)
+		c.Close()
+	}
+}
+
+// handle answers the greeting and one CONNECT request, then copies data
+// both ways until either side closes
+func (s *Server) handle(c net.Conn) {
+	var head [2]byte
+	if _, err := io.ReadFull(c, head[:]); err != nil || head[0] != 5 {
+		return
+	}
+	if _, err := io.CopyN(io.Discard, c, int64(head[1])); err != nil {
+		return
+	}
+	if _, err := c.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return
+	}
+	host, err := readHost(c, req[3])
+	if err != nil {
+		return
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return
+	}
+	portStr := strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))
+	addr := net.JoinHostPort(host, portStr)
+	if req[1] != 1 {
+		// Only CONNECT is supported
+		c.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	s.mu.Lock()
+	s.dials = append(s.dials, addr)
+	if ip, ok := s.hosts[host]; ok {
+		host = ip
+	}
+	s.mu.Unlock()
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, portStr))
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	s.track(target, true)
+	defer s.track(target, false)
+	if _, err := c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, c)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, target)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// readHost reads the address of a request with address type atyp
+func readHost(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case 1:
+		ip := make([]byte, 4)
+		_, err := io.ReadFull(r, ip)
+		return net.IP(ip).String(), err
+	case 4:
+		ip := make([]byte, 16)
+		_, err := io.ReadFull(r, ip)
+		return net.IP(ip).String(), err
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		_, err := io.ReadFull(r, name)
+		return string(name), err
+	}
+	return "", fmt.Errorf("unknown address type %d", atyp)
+}
@@ -0,0 +1,25 @@
+package proxy
+
+// Config routes traffic through a SOCKS5 or HTTP proxy. Each category can be
+// switched on its own, Only forces every category through the proxy and
+// turns off whatever cannot use it, so nothing connects directly.
+type Config struct {
+	// URL is socks5://[user:pass@]host:port or http://[user:pass@]host:port,
+	// empty disables the proxy
+	URL string `json:"url"`
+
+	Peers    bool `json:"peers"`    // peer connections, which turns off incoming peers, uTP and DHT
+	Trackers bool `json:"trackers"` // HTTP trackers and web seeds, UDP trackers are skipped
+	Crawler  bool `json:"crawler"`  // search provider requests
+
+	Only bool `json:"only"`
+}
+
+// Default returns a configuration that proxies every category once a URL is set
+func Default() Config {
+	return Config{
+		Peers:    true,
+		Trackers: true,
+		Crawler:  true,
+	}
+}
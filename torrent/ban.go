@@ -0,0 +1,205 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/iplist"
+)
+
+// Ban is a peer address refused for the rest of the session
+type Ban struct {
+	Addr   netip.Addr
+	Reason string
+	At     time.Time
+}
+
+// banList holds the banned addresses of a session and the hash failures
+// counted against every peer. It is the IP blocklist of the client, so
+// banned peers cannot connect again.
+type banList struct {
+	mu    sync.RWMutex
+	bans  map[netip.Addr]Ban
+	fails map[netip.Addr]int
+}
+
+func newBanList() *banList {
+	return &banList{
+		bans:  make(map[netip.Addr]Ban),
+		fails: make(map[netip.Addr]int),
+	}
+}
+
+// Lookup implements iplist.Ranger
+func (b *banList) Lookup(ip net.IP) (iplist.Range, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return iplist.Range{}, false
+	}
+	ban, ok := b.reason(addr)
+	if !ok {
+		return iplist.Range{}, false
+	}
+	return iplist.Range{First: ip, Last: ip, Description: ban.Reason}, true
+}
+
+// NumRanges implements iplist.Ranger
+func (b *banList) NumRanges() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.bans)
+}
+
+// reason returns the ban of addr, nil-safe for one-shot clients
+func (b *banList) reason(addr netip.Addr) (Ban, bool) {
+	if b == nil {
+		return Ban{}, false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ban, ok := b.bans[addr.Unmap()]
+	return ban, ok
+}
+
+// hashFails returns how many pieces from addr failed the hash check
+func (b *banList) hashFails(addr netip.Addr) int {
+	if b == nil {
+		return 0
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.fails[addr.Unmap()]
+}
+
+// peerAddr returns the IP of a connection
+func peerAddr(pc *torrent.PeerConn) (netip.Addr, bool) {
+	if pc.RemoteAddr == nil {
+		return netip.Addr{}, false
+	}
+	ap, err := netip.ParseAddrPort(pc.RemoteAddr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+// noteOffenders remembers the peers that sent a piece failing the hash check
+func (h *Handle) noteOffenders(sent map[string]netip.Addr) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.offenders == nil {
+		h.offenders = make(map[string]netip.Addr)
+	}
+	for addr, ip := range sent {
+		h.offenders[addr] = ip
+	}
+}
+
+// blameHashFail counts a failed piece against every peer that sent data
+// for it and bans those reaching the ban_hash_fails limit. A peer counts
+// once per piece however many of its connections took part. anacrolix
+// bans a peer on its own when it alone sent a bad piece, such bans are
+// recorded too so the reason shows up.
+func (s *Session) blameHashFail(h *Handle, sent map[string]netip.Addr) {
+	limit := s.config.BanHashFails
+	var banned []Ban
+
+	blamed := make(map[netip.Addr]bool)
+	for _, addr := range sent {
+		blamed[addr] = true
+	}
+	clientBans := make(map[netip.Addr]bool)
+	for _, ip := range s.client.BadPeerIPs() {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			clientBans[addr.Unmap()] = true
+		}
+	}
+
+	s.bans.mu.Lock()
+	for addr := range blamed {
+		s.bans.fails[addr]++
+		n := s.bans.fails[addr]
+		if _, done := s.bans.bans[addr]; done {
+			continue
+		}
+		if !clientBans[addr] && (limit <= 0 || n < limit) {
+			continue
+		}
+		reason := "sent a piece that failed the hash check"
+		if n > 1 {
+			reason = fmt.Sprintf("sent %d pieces that failed the hash check", n)
+		}
+		ban := Ban{Addr: addr, Reason: reason, At: time.Now()}
+		s.bans.bans[addr] = ban
+		banned = append(banned, ban)
+	}
+	s.bans.mu.Unlock()
+
+	for _, ban := range banned {
+		s.dropPeer(ban.Addr)
+		s.publish(PeerBannedEvent{EventHeader: h.eventHeader(), Ban: ban})
+	}
+}
+
+// Ban refuses connections from addr for the rest of the session and
+// drops those already open
+func (s *Session) Ban(addr, reason string) error {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	ip = ip.Unmap()
+	ban := Ban{Addr: ip, Reason: reason, At: time.Now()}
+	s.bans.mu.Lock()
+	s.bans.bans[ip] = ban
+	s.bans.mu.Unlock()
+
+	s.dropPeer(ip)
+	s.publish(PeerBannedEvent{EventHeader: EventHeader{At: ban.At}, Ban: ban})
+	return nil
+}
+
+// Unban lifts a ban and forgets the hash failures counted against addr
+func (s *Session) Unban(addr string) error {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	s.bans.mu.Lock()
+	defer s.bans.mu.Unlock()
+	if _, ok := s.bans.bans[ip.Unmap()]; !ok {
+		return fmt.Errorf("%s is not banned", addr)
+	}
+	delete(s.bans.bans, ip.Unmap())
+	delete(s.bans.fails, ip.Unmap())
+	return nil
+}
+
+// Bans returns the banned addresses, oldest first
+func (s *Session) Bans() []Ban {
+	s.bans.mu.RLock()
+	bans := make([]Ban, 0, len(s.bans.bans))
+	for _, ban := range s.bans.bans {
+		bans = append(bans, ban)
+	}
+	s.bans.mu.RUnlock()
+
+	sort.Slice(bans, func(i, j int) bool { return bans[i].At.Before(bans[j].At) })
+	return bans
+}
+
+// dropPeer closes every connection from addr across the session
+func (s *Session) dropPeer(addr netip.Addr) {
+	for _, h := range s.Torrents() {
+		for _, pc := range h.tor.PeerConns() {
+			if ip, ok := peerAddr(pc); ok && ip == addr {
+				pc.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,654 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/dialer"
+	"github.com/serene-brew/ztorrent/proxy"
+)
+
+// interfacePoll is how often the listen interface is checked
+const interfacePoll = 2 * time.Second
+
+// InterfaceState is the state of the interface a session is bound to
+type InterfaceState struct {
+	Name  string // empty when the session is not bound
+	Up    bool
+	Addrs []string
+	Since time.Time // when Up last changed
+}
+
+// interfaceWatch tracks the listen interface, torrents are held while it is down
+type interfaceWatch struct {
+	mu    sync.Mutex
+	state InterfaceState
+}
+
+// newInterfaceWatch returns nil when no interface is configured
+func newInterfaceWatch(name string) *interfaceWatch {
+	if name == "" {
+		return nil
+	}
+	w := &interfaceWatch{state: InterfaceState{Name: name, Since: time.Now()}}
+	w.poll(time.Now())
+	return w
+}
+
+// poll checks the interface again and reports whether it went up or down
+// and whether its addresses changed
+func (w *interfaceWatch) poll(now time.Time) (upChanged, addrsChanged bool) {
+	hosts, err := resolveListenInterface(w.state.Name)
+	up := err == nil && interfaceHolds(hosts)
+
+	var addrs []string
+	for _, ip := range []string{hosts.ipv4, hosts.ipv6} {
+		if up && ip != "" {
+			addrs = append(addrs, ip)
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	upChanged = up != w.state.Up
+	addrsChanged = strings.Join(addrs, " ") != strings.Join(w.state.Addrs, " ")
+	w.state.Up = up
+	w.state.Addrs = addrs
+	if upChanged {
+		w.state.Since = now
+	}
+	return upChanged, addrsChanged
+}
+
+// down reports whether torrents must be held, false when not bound
+func (w *interfaceWatch) down() bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.state.Up
+}
+
+// interfaceHolds reports whether an interface that is up still owns the
+// addresses, a configured IP resolves even after its interface is gone
+func interfaceHolds(hosts listenHosts) bool {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip := ipNet.IP.String(); ip == hosts.ipv4 || ip == hosts.ipv6 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Interface returns the state of the listen interface
+func (s *Session) Interface() InterfaceState {
+	if s.iface == nil {
+		return InterfaceState{}
+	}
+	s.iface.mu.Lock()
+	defer s.iface.mu.Unlock()
+	state := s.iface.state
+	state.Addrs = append([]string(nil), state.Addrs...)
+	return state
+}
+
+// interfaceLoop holds every torrent while the listen interface is down and
+// releases them once it returns, moving the sockets to its addresses
+// whenever they change, until the session closes
+func (s *Session) interfaceLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interfacePoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			upChanged, addrsChanged := s.iface.poll(now)
+			if (upChanged || addrsChanged) && s.sockets != nil {
+				if err := s.sockets.rebind(); err != nil {
+					s.logf("listen interface %s: %v", s.config.ListenInterface, err)
+				}
+			}
+			if !upChanged {
+				continue
+			}
+			up := !s.iface.down()
+			for _, h := range s.Torrents() {
+				if up {
+					// Time spent offline does not count towards stalling
+					h.mu.Lock()
+					h.activeAt = now
+					h.mu.Unlock()
+				}
+				h.updateTransfer()
+			}
+			s.updateQueue()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// bindDialer dials from the current address of the listen interface, so
+// nothing leaves through another route while it is down. Host names are
+// looked up through the interface as well.
+func bindDialer(name string) proxy.DialFunc {
+	resolver := bindResolver(name)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		local, family, err := bindAddr(name, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: local}, Resolver: resolver}
+		return d.DialContext(ctx, "tcp"+family, addr)
+	}
+}
+
+// bindResolver queries the system name servers from the listen interface.
+// The pure Go resolver is needed for Dial to be used.
+func bindResolver(name string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			local, family, err := bindAddr(name, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			d := net.Dialer{LocalAddr: &net.TCPAddr{IP: local}}
+			if strings.HasPrefix(network, "udp") {
+				d.LocalAddr = &net.UDPAddr{IP: local}
+			}
+			return d.DialContext(ctx, strings.TrimRight(network, "46")+family, addr)
+		},
+	}
+}
+
+// bindLookupTracker resolves tracker hosts with resolver, which anacrolix
+// would otherwise do with the system resolver on the default route
+func bindLookupTracker(resolver *net.Resolver) func(*url.URL) ([]net.IP, error) {
+	return func(u *url.URL) ([]net.IP, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return resolver.LookupIP(ctx, "ip", u.Hostname())
+	}
+}
+
+// bindListenPacket opens UDP tracker sockets on the listen interface
+func bindListenPacket(name string) func(network, addr string) (net.PacketConn, error) {
+	return func(network, addr string) (net.PacketConn, error) {
+		local, family, err := bindAddr(name, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return net.ListenUDP("udp"+family, &net.UDPAddr{IP: local})
+	}
+}
+
+// bindAddr picks the interface address of the family network or addr
+// needs, preferring IPv4 when either would do
+func bindAddr(name, network, addr string) (net.IP, string, error) {
+	hosts, err := resolveListenInterface(name)
+	if err != nil {
+		return nil, "", err
+	}
+	want := ""
+	switch {
+	case strings.HasSuffix(network, "4"):
+		want = "4"
+	case strings.HasSuffix(network, "6"):
+		want = "6"
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			want = "6"
+			if ip.To4() != nil {
+				want = "4"
+			}
+		}
+	}
+
+	if hosts.ipv4 != "" && want != "6" {
+		return net.ParseIP(hosts.ipv4), "4", nil
+	}
+	if hosts.ipv6 != "" && want != "4" {
+		return net.ParseIP(hosts.ipv6), "6", nil
+	}
+	return nil, "", fmt.Errorf("listen interface %q has no IPv%s address", name, want)
+}
+
+// bindClient binds the connections of cfg to the listen interface. anacrolix
+// opens its peer sockets once, on the addresses the interface had at the
+// time, so they are turned off here and replaced by the returned sockets,
+// which follow the interface. Outgoing TCP uses a dialer bound to it.
+func bindClient(cfg *torrent.ClientConfig, conf Config, peerDialer torrent.Dialer) (*boundSockets, torrent.Dialer) {
+	name := conf.ListenInterface
+	bound := bindDialer(name)
+	if cfg.TrackerDialContext == nil {
+		cfg.TrackerDialContext = bound
+	}
+	if cfg.TrackerListenPacket == nil {
+		cfg.TrackerListenPacket = bindListenPacket(name)
+	}
+	if cfg.HTTPDialContext == nil {
+		cfg.HTTPDialContext = bound
+	}
+	// A proxy resolving tracker names has set its own lookup
+	if cfg.LookupTrackerIp == nil {
+		cfg.LookupTrackerIp = bindLookupTracker(bindResolver(name))
+	}
+	// WebRTC and UPnP would use every interface
+	cfg.DisableWebtorrent = true
+	cfg.NoDefaultPortForwarding = true
+
+	if peerDialer != nil {
+		// Peers go through a proxy reached with the bound dialer, which
+		// already turned off every peer socket
+		return nil, peerDialer
+	}
+
+	b := &boundSockets{
+		name: name,
+		port: cfg.ListenPort,
+		tcp:  !cfg.DisableTCP,
+		utp:  !cfg.DisableUTP,
+		dht:  !cfg.NoDHT,
+	}
+	if !cfg.DisableIPv4 {
+		b.families = append(b.families, &familySockets{family: "4"})
+	}
+	if !cfg.DisableIPv6 {
+		b.families = append(b.families, &familySockets{family: "6"})
+	}
+	if b.tcp {
+		peerDialer = dialer.WithNetwork{Network: "tcp", Dialer: bound}
+	}
+	cfg.DisableTCP = true
+	cfg.DisableUTP = true
+	cfg.NoDHT = true
+	return b, peerDialer
+}
+
+// boundSockets are the TCP, uTP and DHT sockets of a client bound to the
+// listen interface. The client is handed stand-ins that stay the same while
+// rebind reopens the sockets behind them on the current addresses.
+type boundSockets struct {
+	name          string
+	tcp, utp, dht bool
+	families      []*familySockets
+
+	mu   sync.Mutex
+	port int // zero until the first socket picks one, then kept
+}
+
+type familySockets struct {
+	family string // "4" or "6"
+	tcp    *boundListener
+	udp    *boundUTP
+}
+
+// attach gives the stand-ins to client, opens the sockets where the
+// interface has an address and closes them with the client
+func (b *boundSockets) attach(client *torrent.Client) error {
+	var servers []*dht.Server
+	for _, f := range b.families {
+		if b.tcp {
+			f.tcp = &boundListener{socketSlot{addr: &net.TCPAddr{}}}
+			client.AddListener(f.tcp)
+		}
+		if !b.utp && !b.dht {
+			continue
+		}
+		f.udp = &boundUTP{socketSlot: socketSlot{addr: &net.UDPAddr{}}, network: "udp" + f.family}
+		if b.utp {
+			client.AddListener(f.udp)
+			client.AddDialer(f.udp)
+		}
+		if b.dht {
+			ds, err := client.NewAnacrolixDhtServer(f.udp)
+			if err != nil {
+				return fmt.Errorf("failed to start DHT: %v", err)
+			}
+			client.AddDhtServer(torrent.AnacrolixDhtServerWrapper{Server: ds})
+			servers = append(servers, ds)
+		}
+	}
+	go func() {
+		<-client.Closed()
+		for _, ds := range servers {
+			ds.Close()
+		}
+		b.close()
+	}()
+	return b.rebind()
+}
+
+// rebind closes the sockets and opens them again on the addresses the
+// interface has now. Families without an address stay closed, and every
+// family is closed while the interface is gone.
+func (b *boundSockets) rebind() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hosts, err := resolveListenInterface(b.name)
+	if err != nil || !interfaceHolds(hosts) {
+		hosts = listenHosts{}
+	}
+	var first error
+	for _, f := range b.families {
+		host := hosts.ipv4
+		if f.family == "6" {
+			host = hosts.ipv6
+		}
+		if host == "" {
+			f.set(nil, nil)
+			continue
+		}
+		if err := b.open(f, host); err != nil {
+			f.set(nil, nil)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// open replaces the sockets of f with ones on host, sharing the port
+// between TCP and uTP like the built in sockets do
+func (b *boundSockets) open(f *familySockets, host string) error {
+	// The old sockets hold the port until they are closed
+	f.set(nil, nil)
+
+	var l net.Listener
+	if f.tcp != nil {
+		var err error
+		l, err = net.Listen("tcp"+f.family, net.JoinHostPort(host, strconv.Itoa(b.port)))
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %v", host, err)
+		}
+		b.port = l.Addr().(*net.TCPAddr).Port
+	}
+	var u utpSocket
+	if f.udp != nil {
+		s, err := torrent.NewUtpSocket(f.udp.network, net.JoinHostPort(host, strconv.Itoa(b.port)), nil, log.Default)
+		if err != nil {
+			if l != nil {
+				l.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %v", host, err)
+		}
+		u = s
+		b.port = u.Addr().(*net.UDPAddr).Port
+	}
+	f.set(l, u)
+	return nil
+}
+
+func (f *familySockets) set(l net.Listener, u utpSocket) {
+	if f.tcp != nil {
+		if l == nil {
+			f.tcp.set(nil, nil)
+		} else {
+			f.tcp.set(l, l.Addr())
+		}
+	}
+	if f.udp != nil {
+		if u == nil {
+			f.udp.set(nil, nil)
+		} else {
+			f.udp.set(u, u.Addr())
+		}
+	}
+}
+
+func (b *boundSockets) close() {
+	for _, f := range b.families {
+		if f.tcp != nil {
+			f.tcp.close()
+		}
+		if f.udp != nil {
+			f.udp.close()
+		}
+	}
+}
+
+// socketSlot holds the socket currently standing behind a stand-in, nil
+// while there is none. Blocking calls wait for a socket and move on to the
+// next one when theirs is replaced underneath them.
+type socketSlot struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	cur    io.Closer
+	addr   net.Addr // of the current socket, or the last one while closed
+	closed bool
+}
+
+func (s *socketSlot) init() {
+	if s.cond == nil {
+		s.cond = sync.NewCond(&s.mu)
+	}
+}
+
+// wait returns the current socket, blocking while there is none
+func (s *socketSlot) wait() (io.Closer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	for s.cur == nil && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return nil, net.ErrClosed
+	}
+	return s.cur, nil
+}
+
+// get returns the current socket without waiting
+func (s *socketSlot) get() (io.Closer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, net.ErrClosed
+	}
+	if s.cur == nil {
+		return nil, fmt.Errorf("listen interface is down")
+	}
+	return s.cur, nil
+}
+
+// replaced reports whether c is no longer the current socket, so an error
+// from it only means it was closed by set
+func (s *socketSlot) replaced(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur != c && !s.closed
+}
+
+func (s *socketSlot) set(c io.Closer, addr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	if s.closed {
+		if c != nil {
+			c.Close()
+		}
+		return
+	}
+	if s.cur != nil {
+		s.cur.Close()
+	}
+	s.cur = c
+	if addr != nil {
+		s.addr = addr
+	}
+	s.cond.Broadcast()
+}
+
+func (s *socketSlot) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	s.closed = true
+	if s.cur != nil {
+		s.cur.Close()
+		s.cur = nil
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *socketSlot) lastAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// boundListener stands in for the TCP listener of one address family
+type boundListener struct {
+	socketSlot
+}
+
+func (l *boundListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.wait()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := c.(net.Listener).Accept()
+		if err == nil || !l.replaced(c) {
+			return conn, err
+		}
+	}
+}
+
+func (l *boundListener) Addr() net.Addr {
+	return l.lastAddr()
+}
+
+// utpSocket is what torrent.NewUtpSocket returns
+type utpSocket interface {
+	net.PacketConn
+	Accept() (net.Conn, error)
+	Addr() net.Addr
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// boundUTP stands in for the uTP socket of one address family, which also
+// carries the DHT of that family
+type boundUTP struct {
+	socketSlot
+	network string
+}
+
+func (u *boundUTP) Accept() (net.Conn, error) {
+	for {
+		c, err := u.wait()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := c.(utpSocket).Accept()
+		if err == nil || !u.replaced(c) {
+			return conn, err
+		}
+	}
+}
+
+func (u *boundUTP) Addr() net.Addr {
+	return u.lastAddr()
+}
+
+// Dial implements torrent.Dialer
+func (u *boundUTP) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	c, err := u.get()
+	if err != nil {
+		return nil, err
+	}
+	return c.(utpSocket).DialContext(ctx, u.network, addr)
+}
+
+// DialerNetwork implements torrent.Dialer
+func (u *boundUTP) DialerNetwork() string {
+	return u.network
+}
+
+func (u *boundUTP) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c, err := u.wait()
+		if err != nil {
+			return 0, nil, err
+		}
+		n, addr, err := c.(utpSocket).ReadFrom(b)
+		if err == nil || !u.replaced(c) {
+			return n, addr, err
+		}
+	}
+}
+
+func (u *boundUTP) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c, err := u.get()
+	if err != nil {
+		return 0, err
+	}
+	return c.(utpSocket).WriteTo(b, addr)
+}
+
+func (u *boundUTP) Close() error {
+	return u.close()
+}
+
+func (u *boundUTP) LocalAddr() net.Addr {
+	return u.lastAddr()
+}
+
+// Deadlines apply to the current socket only, the DHT does not set any
+func (u *boundUTP) SetDeadline(t time.Time) error {
+	c, err := u.get()
+	if err != nil {
+		return err
+	}
+	return c.(utpSocket).SetDeadline(t)
+}
+
+func (u *boundUTP) SetReadDeadline(t time.Time) error {
+	c, err := u.get()
+	if err != nil {
+		return err
+	}
+	return c.(utpSocket).SetReadDeadline(t)
+}
+
+func (u *boundUTP) SetWriteDeadline(t time.Time) error {
+	c, err := u.get()
+	if err != nil {
+		return err
+	}
+	return c.(utpSocket).SetWriteDeadline(t)
+}
@@ -0,0 +1,357 @@
+package torrent
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent/iplist"
+)
+
+const (
+	// blocklistPoll is how often a blocklist file is checked for changes
+	blocklistPoll = time.Minute
+	// blocklistRetry is how soon a failed load is tried again
+	blocklistRetry = 5 * time.Minute
+)
+
+// Blocklist is a compiled IP filter of sorted, non-overlapping ranges
+type Blocklist struct {
+	ranges []ipRange
+}
+
+// LoadBlocklist reads a blocklist from a file or an http(s) URL. Lists may
+// be gzip compressed and mix the P2P ("desc:first-last"), eMule DAT
+// ("first - last , level , desc") and CIDR ("1.2.3.0/24") line formats.
+func LoadBlocklist(source string) (*Blocklist, error) {
+	return loadBlocklist(source, &http.Client{Timeout: time.Minute})
+}
+
+// loadBlocklist is LoadBlocklist downloading with client
+func loadBlocklist(source string, client *http.Client) (*Blocklist, error) {
+	var r io.ReadCloser
+	if isURL(source) {
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download blocklist: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to download blocklist: %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open blocklist: %v", err)
+		}
+		r = f
+	}
+	defer r.Close()
+	return ParseBlocklist(r)
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// ParseBlocklist compiles a blocklist, skipping lines it does not understand
+func ParseBlocklist(r io.Reader) (*Blocklist, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read blocklist: %v", err)
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	var ranges []ipRange
+	scanner := bufio.NewScanner(br)
+	for scanner.Scan() {
+		if r, ok := parseBlocklistLine(scanner.Text()); ok {
+			ranges = append(ranges, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blocklist: %v", err)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no address ranges in blocklist")
+	}
+	return &Blocklist{ranges: mergeRanges(ranges)}, nil
+}
+
+// Lookup returns the description of the range holding addr
+func (b *Blocklist) Lookup(addr netip.Addr) (string, bool) {
+	if b == nil {
+		return "", false
+	}
+	r, ok := findRange(b.ranges, addr.Unmap())
+	return r.value, ok
+}
+
+// Len returns the number of ranges after merging overlaps
+func (b *Blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.ranges)
+}
+
+// parseBlocklistLine reads one line in any of the supported formats
+func parseBlocklistLine(line string) (ipRange, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+		return ipRange{}, false
+	}
+
+	// eMule DAT, levels above 127 are allowed rather than blocked
+	if fields := strings.Split(line, ","); len(fields) >= 3 {
+		r, ok := parseAddrRange(fields[0])
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if ok && err == nil {
+			if level > 127 {
+				return ipRange{}, false
+			}
+			r.value = strings.TrimSpace(strings.Join(fields[2:], ","))
+			return r, true
+		}
+	}
+
+	// CIDR or a single address, optionally followed by a description
+	fields := strings.Fields(line)
+	if prefix, err := netip.ParsePrefix(fields[0]); err == nil {
+		return ipRange{
+			first: prefix.Masked().Addr(),
+			last:  lastAddr(prefix),
+			value: strings.TrimSpace(strings.TrimPrefix(line, fields[0])),
+		}, true
+	}
+	if addr, ok := parseBlocklistAddr(fields[0]); ok {
+		return ipRange{first: addr, last: addr, value: strings.TrimSpace(strings.TrimPrefix(line, fields[0]))}, true
+	}
+
+	// A bare range, then P2P where the description may itself contain colons
+	if r, ok := parseAddrRange(line); ok {
+		return r, true
+	}
+	if i := strings.LastIndex(line, ":"); i > 0 {
+		if r, ok := parseAddrRange(line[i+1:]); ok {
+			r.value = strings.TrimSpace(line[:i])
+			return r, true
+		}
+	}
+	return ipRange{}, false
+}
+
+// parseAddrRange reads "first-last" with optional spaces around the dash
+func parseAddrRange(s string) (ipRange, bool) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return ipRange{}, false
+	}
+	first, ok1 := parseBlocklistAddr(from)
+	last, ok2 := parseBlocklistAddr(to)
+	if !ok1 || !ok2 || first.Is4() != last.Is4() || last.Less(first) {
+		return ipRange{}, false
+	}
+	return ipRange{first: first, last: last}, true
+}
+
+// parseBlocklistAddr accepts the zero padded IPv4 of DAT files, e.g. 001.002.003.004
+func parseBlocklistAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), true
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return netip.Addr{}, false
+	}
+	var b [4]byte
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 255 {
+			return netip.Addr{}, false
+		}
+		b[i] = byte(n)
+	}
+	return netip.AddrFrom4(b), true
+}
+
+// lastAddr returns the highest address of a prefix
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// mergeRanges sorts ranges and joins those that overlap or touch, so a
+// binary search finds the single range holding an address
+func mergeRanges(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first.Less(ranges[j].first)
+	})
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		cur := &merged[len(merged)-1]
+		next := cur.last.Next() // invalid past the highest address
+		if cur.first.Is4() == r.first.Is4() && (!next.IsValid() || !next.Less(r.first)) {
+			if cur.last.Less(r.last) {
+				cur.last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// BlocklistStats describes the loaded blocklist of a session
+type BlocklistStats struct {
+	Source   string
+	Ranges   int
+	Blocked  int64 // connection attempts refused by the list
+	LoadedAt time.Time
+	Err      error // of the last load, the previous list stays in use
+}
+
+// peerFilter is the IP blocklist of the client: session bans and the
+// configured blocklist, which is swapped in place on reload
+type peerFilter struct {
+	bans    *banList
+	blocked atomic.Int64
+
+	mu       sync.RWMutex
+	list     *Blocklist
+	modTime  time.Time
+	loadedAt time.Time
+	tried    time.Time
+	err      error
+}
+
+// Lookup implements iplist.Ranger
+func (f *peerFilter) Lookup(ip net.IP) (iplist.Range, bool) {
+	if r, ok := f.bans.Lookup(ip); ok {
+		return r, true
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return iplist.Range{}, false
+	}
+	// Placeholders stand for tracker names the proxy resolves, see trackerNames
+	if trackerNameRange.Contains(addr.Unmap()) {
+		return iplist.Range{}, false
+	}
+	f.mu.RLock()
+	list := f.list
+	f.mu.RUnlock()
+	desc, ok := list.Lookup(addr)
+	if !ok {
+		return iplist.Range{}, false
+	}
+	f.blocked.Add(1)
+	return iplist.Range{First: ip, Last: ip, Description: desc}, true
+}
+
+// NumRanges implements iplist.Ranger
+func (f *peerFilter) NumRanges() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.bans.NumRanges() + f.list.Len()
+}
+
+// ReloadBlocklist loads the configured blocklist again, keeping the
+// current one when that fails
+func (s *Session) ReloadBlocklist() error {
+	source := s.config.Blocklist
+	if source == "" {
+		return fmt.Errorf("no blocklist configured")
+	}
+	var modTime time.Time
+	if st, err := os.Stat(source); err == nil {
+		modTime = st.ModTime()
+	}
+	p := s.config.Proxy
+	client, err := p.HTTPClient(p.Only, time.Minute)
+	if err != nil {
+		return err
+	}
+	list, err := loadBlocklist(source, client)
+
+	f := s.filter
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tried = time.Now()
+	f.err = err
+	if err != nil {
+		return err
+	}
+	f.list, f.modTime, f.loadedAt = list, modTime, f.tried
+	return nil
+}
+
+// BlocklistStats returns the state of the configured blocklist
+func (s *Session) BlocklistStats() BlocklistStats {
+	f := s.filter
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return BlocklistStats{
+		Source:   s.config.Blocklist,
+		Ranges:   f.list.Len(),
+		Blocked:  f.blocked.Load(),
+		LoadedAt: f.loadedAt,
+		Err:      f.err,
+	}
+}
+
+// blocklistDue reports whether the blocklist should be loaded again: when
+// its file changed, its reload interval passed or the last load failed
+func (s *Session) blocklistDue(now time.Time) bool {
+	f := s.filter
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.err != nil {
+		return now.Sub(f.tried) >= blocklistRetry
+	}
+	if every := s.config.BlocklistReloadMinutes; every > 0 && now.Sub(f.tried) >= time.Duration(every)*time.Minute {
+		return true
+	}
+	st, err := os.Stat(s.config.Blocklist)
+	return err == nil && !st.ModTime().Equal(f.modTime)
+}
+
+// blocklistLoop keeps the blocklist current until the session closes
+func (s *Session) blocklistLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(blocklistPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if s.blocklistDue(now) {
+				s.ReloadBlocklist()
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
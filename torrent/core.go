@@ -15,7 +15,30 @@ func GetDefaultDownloadPath() string {
 	return filepath.Join(homeDir, "Downloads")
 }
 
-func DownloadFromMagnet(magnetURI string, downloadPath string) (<-chan ProgressInfo, error) {
+// DefaultStateDir returns $XDG_STATE_HOME/ztorrent, falling back to ~/.local/state/ztorrent
+func DefaultStateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "ztorrent")
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join("/home", os.Getenv("USER"), ".local", "state", "ztorrent")
+	}
+	return filepath.Join(homeDir, ".local", "state", "ztorrent")
+}
+
+// DownloadFromMagnet downloads the files selected by rules, or every file when
+// no rules are given, reporting progress until they are complete. The client
+// takes its network settings, such as the proxy, from conf. It does not seed,
+// the channel closes once the download finishes; add the torrent to a
+// Session to seed it. A failure ends the updates with one carrying Err.
+func DownloadFromMagnet(conf Config, magnetURI string, downloadPath string, rules ...FileRule) (<-chan ProgressInfo, error) {
+	selectOnly, err := selectOnlyRules(magnetURI)
+	if err != nil {
+		return nil, err
+	}
+	rules = append(selectOnly, rules...)
+
 	if downloadPath == "" {
 		downloadPath = GetDefaultDownloadPath()
 	}
@@ -24,7 +47,9 @@ func DownloadFromMagnet(magnetURI string, downloadPath string) (<-chan ProgressI
 		return nil, fmt.Errorf("failed to create downloads directory: %v", err)
 	}
 
-	client, err := createTorrentClient(downloadPath)
+	// One-shot downloads end with the download, there is no session to seed from
+	conf.Seed = false
+	client, _, err := createTorrentClient(conf, downloadPath, nil, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("client creation failed: %v", err)
 	}
@@ -37,21 +62,24 @@ func DownloadFromMagnet(magnetURI string, downloadPath string) (<-chan ProgressI
 
 		tor, err := client.AddMagnet(magnetURI)
 		if err != nil {
+			progress <- ProgressInfo{ETA: -1, Err: fmt.Errorf("failed to add magnet: %v", err)}
 			return
 		}
 
 		<-tor.GotInfo()
-		tor.DownloadAll()
+		prios, err := selectFiles(tor, rules)
+		if err != nil {
+			progress <- ProgressInfo{ETA: -1, Err: fmt.Errorf("file rules: %v", err)}
+			return
+		}
 
 		startTime := time.Now()
+		rates := NewRateEstimator()
 
 		for {
-			completed := tor.BytesCompleted()
-			total := tor.Length()
+			progress <- GetProgressInfo(tor, startTime, rates)
 
-			progress <- GetProgressInfo(tor, startTime)
-
-			if completed == total {
+			if filesComplete(tor, prios) {
 				return
 			}
 			time.Sleep(500 * time.Millisecond)
@@ -61,8 +89,12 @@ func DownloadFromMagnet(magnetURI string, downloadPath string) (<-chan ProgressI
 	return progress, nil
 }
 
-func GetPeers(magnetURI string) (*TorrentInfo, []PeerInfo, error) {
-	client, err := createTorrentClient("")
+// GetPeers waits for the metadata of magnetURI with a client configured by
+// conf and returns it with the peers connected so far
+func GetPeers(conf Config, magnetURI string) (*TorrentInfo, []PeerInfo, error) {
+	// Probes only need metadata, so nothing is written to disk
+	conf.Storage = StorageMemory
+	client, _, err := createTorrentClient(conf, "", nil, nil, nil)
 	if err != nil {
 		return nil, nil, fmt.Errorf("client creation failed: %v", err)
 	}
@@ -84,17 +116,12 @@ func GetPeers(magnetURI string) (*TorrentInfo, []PeerInfo, error) {
 	return torrentInfo, peerInfo, nil
 }
 
-func GetPeersFromFile(torrentPath string) (*TorrentInfo, []PeerInfo, error) {
-	client, err := createTorrentClient("")
-	if err != nil {
-		return nil, nil, fmt.Errorf("client creation failed: %v", err)
-	}
-	defer client.Close()
-
+// GetPeersFromFile is GetPeers for the torrent file at torrentPath
+func GetPeersFromFile(conf Config, torrentPath string) (*TorrentInfo, []PeerInfo, error) {
 	magnetLink, err := generateMagnetFromFile(torrentPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("magnet generation failed: %v", err)
 	}
 
-	return GetPeers(magnetLink)
+	return GetPeers(conf, magnetLink)
 }
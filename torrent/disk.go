@@ -0,0 +1,262 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DiskCheck selects what happens when the free space check fails
+type DiskCheck string
+
+const (
+	DiskCheckRefuse DiskCheck = "refuse" // keep the torrent paused with an error
+	DiskCheckWarn   DiskCheck = "warn"   // download anyway and report a warning
+	DiskCheckOff    DiskCheck = "off"
+)
+
+// Preallocation selects how files are created before downloading
+type Preallocation string
+
+const (
+	PreallocateNone   Preallocation = "none"
+	PreallocateSparse Preallocation = "sparse" // files get their full size without using space
+	PreallocateFull   Preallocation = "full"   // space for every file is reserved up front
+)
+
+// Validate rejects unknown disk check modes
+func (d DiskCheck) Validate() error {
+	switch d {
+	case DiskCheckRefuse, DiskCheckWarn, DiskCheckOff, "":
+		return nil
+	}
+	return fmt.Errorf("disk_check must be one of refuse, warn or off, got %q", d)
+}
+
+// Validate rejects unknown preallocation modes
+func (p Preallocation) Validate() error {
+	switch p {
+	case PreallocateNone, PreallocateSparse, PreallocateFull, "":
+		return nil
+	}
+	return fmt.Errorf("preallocate must be one of none, sparse or full, got %q", p)
+}
+
+// DiskError is why a torrent stopped on a disk problem. The free space
+// check sets Need and Free, a failed write sets Err.
+type DiskError struct {
+	Path       string
+	Need, Free int64
+	Err        error
+}
+
+func (e *DiskError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("writing to %s failed: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("not enough space in %s: %s needed, %s free",
+		e.Path, HumanReadableSize(e.Need), HumanReadableSize(e.Free))
+}
+
+func (e *DiskError) Unwrap() error {
+	return e.Err
+}
+
+// NoSpace reports whether the disk is full or too small for the torrent
+func (e *DiskError) NoSpace() bool {
+	return e.Err == nil || errors.Is(e.Err, syscall.ENOSPC)
+}
+
+// Err returns why the torrent stopped, nil unless it is in StateError
+func (h *Handle) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Warning returns a problem that did not stop the torrent, such as a
+// failed free space check with disk_check set to warn
+func (h *Handle) Warning() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.warning
+}
+
+// fail pauses the torrent and keeps err until it is resumed
+func (h *Handle) fail(err error) {
+	h.mu.Lock()
+	if h.err != nil {
+		h.mu.Unlock()
+		return
+	}
+	h.err = err
+	h.paused = true
+	h.mu.Unlock()
+
+	h.updateTransfer()
+	h.session.updateQueue()
+	h.save()
+	var diskErr *DiskError
+	if errors.As(err, &diskErr) {
+		h.session.publish(DiskErrorEvent{EventHeader: h.eventHeader(), Err: err})
+	}
+}
+
+// onWriteError is called by anacrolix when a chunk cannot be stored
+func (h *Handle) onWriteError(err error) {
+	h.fail(&DiskError{Path: h.SavePath(), Err: err})
+}
+
+// remainingBytes is what the selected files still need on disk. Space
+// already allocated to a file, such as by preallocation, counts as used.
+func (h *Handle) remainingBytes() int64 {
+	prios := h.FilePriorities()
+	onDisk := h.storageKind.movable()
+	savePath := h.SavePath()
+
+	var need int64
+	for i, f := range h.tor.Files() {
+		if i < len(prios) && prios[i] == PrioritySkip {
+			continue
+		}
+		have := f.BytesCompleted()
+		if onDisk {
+			if allocated := allocatedSize(filepath.Join(savePath, f.Path())); allocated > have {
+				have = allocated
+			}
+		}
+		if have < f.Length() {
+			need += f.Length() - have
+		}
+	}
+	return need
+}
+
+// existingDir returns dir or its nearest ancestor that exists, so the free
+// space of a save path can be read before anything has created it
+func existingDir(dir string) string {
+	dir = filepath.Clean(dir)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// checkSpace compares the free space of the save path with what the
+// torrent still needs. It needs metadata and does nothing without it.
+func (h *Handle) checkSpace() error {
+	mode := h.session.config.DiskCheck
+	if mode == DiskCheckOff || h.storageKind == StorageMemory || h.tor.Info() == nil {
+		return nil
+	}
+	savePath := h.SavePath()
+	free, err := freeSpace(existingDir(savePath))
+	if err != nil {
+		// Unsupported platforms and odd filesystems are not worth refusing over
+		h.session.logf("disk check %s: %v", h.Name(), err)
+		return nil
+	}
+	need := h.remainingBytes()
+	if need <= free {
+		h.mu.Lock()
+		h.warning = nil
+		h.mu.Unlock()
+		return nil
+	}
+
+	diskErr := &DiskError{Path: savePath, Need: need, Free: free}
+	if mode == DiskCheckWarn {
+		h.mu.Lock()
+		h.warning = diskErr
+		h.mu.Unlock()
+		return nil
+	}
+	return diskErr
+}
+
+// prepareDisk runs the free space check and preallocates the selected
+// files, failing the torrent when either goes wrong
+func (h *Handle) prepareDisk() bool {
+	if err := h.checkSpace(); err != nil {
+		h.fail(err)
+		return false
+	}
+	mode := h.session.config.Preallocate
+	if mode == "" || mode == PreallocateNone || !h.storageKind.movable() {
+		return true
+	}
+
+	// Downloads wait so no chunk lands in a range being filled with zeros
+	h.mu.Lock()
+	h.allocating = true
+	h.mu.Unlock()
+	h.updateTransfer()
+	defer func() {
+		h.mu.Lock()
+		h.allocating = false
+		h.mu.Unlock()
+		h.updateTransfer()
+	}()
+
+	prios := h.FilePriorities()
+	savePath := h.SavePath()
+	for i, f := range h.tor.Files() {
+		if i < len(prios) && prios[i] == PrioritySkip {
+			continue
+		}
+		path := filepath.Join(savePath, f.Path())
+		if err := preallocate(path, f.Length(), mode == PreallocateFull); err != nil {
+			h.fail(&DiskError{Path: path, Err: err})
+			return false
+		}
+	}
+	return true
+}
+
+// preallocate grows the file at path to size, writing zeros past its end
+// when full is set so the filesystem reserves the space
+func preallocate(path string, size int64, full bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() >= size {
+		return nil
+	}
+	if !full {
+		return f.Truncate(size)
+	}
+	if _, err := f.Seek(st.Size(), io.SeekStart); err != nil {
+		return err
+	}
+	zeros := make([]byte, 1<<20)
+	for left := size - st.Size(); left > 0; {
+		n := int64(len(zeros))
+		if left < n {
+			n = left
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			return err
+		}
+		left -= n
+	}
+	return f.Sync()
+}
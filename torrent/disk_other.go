@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !freebsd
+
+package torrent
+
+import (
+	"fmt"
+	"os"
+)
+
+// freeSpace is not implemented here, so the free space check is skipped
+func freeSpace(dir string) (int64, error) {
+	return 0, fmt.Errorf("free space is not available on this platform")
+}
+
+// allocatedSize returns the apparent size of a file, zero when it does not exist
+func allocatedSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
@@ -0,0 +1,33 @@
+//go:build linux || darwin || freebsd
+
+package torrent
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem holding dir
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// allocatedSize returns the bytes a file occupies on disk, zero when it
+// does not exist. Sparse files count only their written blocks.
+func allocatedSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if used := st.Blocks * 512; used < fi.Size() {
+			return used
+		}
+	}
+	return fi.Size()
+}
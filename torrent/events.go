@@ -0,0 +1,330 @@
+package torrent
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	// eventInterval is how often torrent states are compared for changes
+	eventInterval = time.Second
+	// eventBuffer is the default capacity of a subscription
+	eventBuffer = 256
+)
+
+// EventType names a kind of Event
+type EventType string
+
+const (
+	EventTorrentAdded     EventType = "torrent_added"
+	EventMetadata         EventType = "metadata_received"
+	EventStateChanged     EventType = "state_changed"
+	EventFileCompleted    EventType = "file_completed"
+	EventTorrentCompleted EventType = "torrent_completed"
+	EventTrackerError     EventType = "tracker_error"
+	EventPeerBanned       EventType = "peer_banned"
+	EventDiskError        EventType = "disk_error"
+	EventSeedGoal         EventType = "seed_goal_reached"
+)
+
+// Event is something that happened in a Session, one of the *Event types
+// below. Switch on the concrete type to read its details.
+type Event interface {
+	Type() EventType
+	Header() EventHeader
+}
+
+// EventHeader holds what every event carries
+type EventHeader struct {
+	At       time.Time
+	InfoHash string // hex, empty for events not tied to one torrent
+	Name     string
+}
+
+// Header returns h, so every event embedding it gets the method
+func (h EventHeader) Header() EventHeader {
+	return h
+}
+
+// TorrentAddedEvent is published when a torrent joins the session. Those
+// restored from a previous run are added inside NewSession, before anyone can
+// subscribe, so they only reach subscriptions asking for them with
+// EventFilter.Restored.
+type TorrentAddedEvent struct {
+	EventHeader
+	Restored bool
+}
+
+// MetadataEvent is published once the info dictionary is known, right
+// away for .torrent files
+type MetadataEvent struct {
+	EventHeader
+	Files int
+	Size  int64
+}
+
+// StateChangedEvent is published when Handle.State changes
+type StateChangedEvent struct {
+	EventHeader
+	From, To TorrentState
+}
+
+// FileCompletedEvent is published when the last piece of a file is verified
+type FileCompletedEvent struct {
+	EventHeader
+	Index int
+	Path  string // as in FileInfo, starting with the torrent name
+	Size  int64
+}
+
+// TorrentCompletedEvent is published when every wanted file has finished,
+// after the data moved to the complete directory if one is set
+type TorrentCompletedEvent struct {
+	EventHeader
+	SavePath string
+	Size     int64
+}
+
+// TrackerErrorEvent is published when an announce fails, once per new
+// error. A tracker that cannot be looked up, reached or that answers a UDP
+// announce with an error counts as failed.
+type TrackerErrorEvent struct {
+	EventHeader
+	Tracker string
+	Message string
+}
+
+// PeerBannedEvent is published when a peer is banned, carrying the torrent
+// it sent corrupt data for when there is one
+type PeerBannedEvent struct {
+	EventHeader
+	Ban Ban
+}
+
+// DiskErrorEvent is published when a disk problem stops a torrent
+type DiskErrorEvent struct {
+	EventHeader
+	Err error
+}
+
+// SeedGoalEvent is published when a torrent reaches its seed goal, just
+// before Action is carried out
+type SeedGoalEvent struct {
+	EventHeader
+	Action SeedAction
+	Reason string // which condition was met, such as "ratio 2.00 reached"
+}
+
+func (TorrentAddedEvent) Type() EventType     { return EventTorrentAdded }
+func (MetadataEvent) Type() EventType         { return EventMetadata }
+func (StateChangedEvent) Type() EventType     { return EventStateChanged }
+func (FileCompletedEvent) Type() EventType    { return EventFileCompleted }
+func (TorrentCompletedEvent) Type() EventType { return EventTorrentCompleted }
+func (TrackerErrorEvent) Type() EventType     { return EventTrackerError }
+func (PeerBannedEvent) Type() EventType       { return EventPeerBanned }
+func (DiskErrorEvent) Type() EventType        { return EventDiskError }
+func (SeedGoalEvent) Type() EventType         { return EventSeedGoal }
+
+// EventFilter selects the events a subscription receives, zero fields match everything
+type EventFilter struct {
+	Types    []EventType
+	InfoHash string
+	// Restored replays the added events of restored torrents still in the
+	// session when subscribing, before any new event
+	Restored bool
+}
+
+// Match reports whether e passes the filter
+func (f EventFilter) Match(e Event) bool {
+	if f.InfoHash != "" && e.Header().InfoHash != f.InfoHash {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == e.Type() {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription receives the events of a session matching its filter.
+// Events are dropped rather than wait for a subscriber whose buffer is full.
+type Subscription struct {
+	bus     *eventBus
+	ch      chan Event
+	filter  EventFilter
+	dropped atomic.Int64
+}
+
+// Events returns the channel events arrive on, closed by Close or when the session closes
+func (sub *Subscription) Events() <-chan Event {
+	return sub.ch
+}
+
+// Dropped returns how many events were lost because the buffer was full
+func (sub *Subscription) Dropped() int64 {
+	return sub.dropped.Load()
+}
+
+// Close stops delivery and closes the events channel
+func (sub *Subscription) Close() {
+	b := sub.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// eventBus fans events out to subscriptions without ever blocking the publisher
+type eventBus struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+	// restored keeps the added events of restored torrents for replay
+	restored []Event
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*Subscription]struct{})}
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if added, ok := e.(TorrentAddedEvent); ok && added.Restored {
+		b.restored = append(b.restored, e)
+	}
+	for sub := range b.subs {
+		if sub.filter.Match(e) {
+			sub.send(e)
+		}
+	}
+}
+
+// send delivers e unless the buffer is full
+func (sub *Subscription) send(e Event) {
+	select {
+	case sub.ch <- e:
+	default:
+		sub.dropped.Add(1)
+	}
+}
+
+// close ends every subscription, later ones start closed
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Subscribe starts receiving the events matching filter. buffer is the
+// channel capacity, zero picks a default. Call Close once done.
+func (s *Session) Subscribe(filter EventFilter, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = eventBuffer
+	}
+	sub := &Subscription{bus: s.events, ch: make(chan Event, buffer), filter: filter}
+	var current map[string]bool
+	if filter.Restored {
+		current = make(map[string]bool)
+		for _, h := range s.Torrents() {
+			current[h.InfoHash()] = true
+		}
+	}
+
+	b := s.events
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.ch)
+		return sub
+	}
+	for _, e := range b.restored {
+		if current[e.Header().InfoHash] && filter.Match(e) {
+			sub.send(e)
+		}
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// publish hands e to every interested subscriber
+func (s *Session) publish(e Event) {
+	s.events.publish(e)
+}
+
+// eventHeader describes h for an event happening now
+func (h *Handle) eventHeader() EventHeader {
+	return EventHeader{At: time.Now(), InfoHash: h.InfoHash(), Name: h.Name()}
+}
+
+// eventLoop publishes state changes, which anacrolix has no callbacks for,
+// until the session closes
+func (s *Session) eventLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(eventInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, h := range s.Torrents() {
+				h.checkState()
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// checkState publishes a change of state since the last check, the first
+// check only records it
+func (h *Handle) checkState() {
+	state := h.State()
+	h.mu.Lock()
+	from, seen := h.reported, h.reportedSeen
+	h.reported, h.reportedSeen = state, true
+	h.mu.Unlock()
+
+	if seen && from != state {
+		h.session.publish(StateChangedEvent{EventHeader: h.eventHeader(), From: from, To: state})
+	}
+}
+
+// completeFiles returns the files of tor already complete, which are not announced
+func completeFiles(tor *torrent.Torrent) map[int]bool {
+	done := make(map[int]bool)
+	for i, f := range tor.Files() {
+		if f.BytesCompleted() == f.Length() {
+			done[i] = true
+		}
+	}
+	return done
+}
+
+// publishCompleteFiles announces the files of piece that the piece
+// completed, recording them in done. A negative piece checks every file.
+func (h *Handle) publishCompleteFiles(piece int, done map[int]bool) {
+	for i, f := range h.tor.Files() {
+		if done[i] || (piece >= 0 && (piece < f.BeginPieceIndex() || piece >= f.EndPieceIndex())) {
+			continue
+		}
+		if f.BytesCompleted() < f.Length() {
+			continue
+		}
+		done[i] = true
+		h.session.publish(FileCompletedEvent{EventHeader: h.eventHeader(), Index: i, Path: f.Path(), Size: f.Length()})
+	}
+}
@@ -0,0 +1,291 @@
+package torrent
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/types"
+	bencode "github.com/serene-brew/ztorrent/bencode"
+)
+
+var priorityNames = map[Priority]string{
+	PrioritySkip:   "skip",
+	PriorityLow:    "low",
+	PriorityNormal: "normal",
+	PriorityHigh:   "high",
+}
+
+// String returns the name used in configs and the TUI
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// ParsePriority accepts skip, low, normal or high
+func ParsePriority(s string) (Priority, error) {
+	for p, name := range priorityNames {
+		if strings.EqualFold(s, name) {
+			return p, nil
+		}
+	}
+	return PrioritySkip, fmt.Errorf("unknown priority %q, want skip, low, normal or high", s)
+}
+
+// OnlyFiles returns rules that skip every file except those matching glob
+func OnlyFiles(glob string) []FileRule {
+	return []FileRule{
+		{Glob: "*", Priority: PrioritySkip},
+		{Glob: glob, Priority: PriorityNormal},
+	}
+}
+
+// OnlyExtensions returns rules that skip every file whose type is not in exts
+func OnlyExtensions(exts ...string) []FileRule {
+	rules := []FileRule{{Glob: "*", Priority: PrioritySkip}}
+	for _, ext := range exts {
+		rules = append(rules, FileRule{Ext: ext, Priority: PriorityNormal})
+	}
+	return rules
+}
+
+// selectOnlyRules converts the BEP 53 so= parameter of a magnet into rules
+func selectOnlyRules(magnetURI string) ([]FileRule, error) {
+	uri, err := url.Parse(magnetURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet URI: %v", err)
+	}
+	ranges, err := bencode.ParseSelectOnly(uri.Query().Get("so"))
+	if err != nil || len(ranges) == 0 {
+		return nil, err
+	}
+
+	// BEP 53 lets clients ignore indices the torrent does not have, which
+	// ranges do
+	rules := []FileRule{{Glob: "*", Priority: PrioritySkip}}
+	for _, r := range ranges {
+		rules = append(rules, FileRule{Index: r.First, Through: r.Last, Priority: PriorityNormal})
+	}
+	return rules, nil
+}
+
+// matches reports whether the rule selects f
+func (r FileRule) matches(f FileInfo) bool {
+	switch {
+	case r.Glob != "":
+		if ok, _ := path.Match(r.Glob, f.Path); ok {
+			return true
+		}
+		ok, _ := path.Match(r.Glob, f.Name)
+		return ok
+	case r.Ext != "":
+		return f.Type == strings.TrimPrefix(r.Ext, ".")
+	case r.isRange():
+		return f.Index >= r.Index && f.Index <= r.Through
+	default:
+		return r.Index == f.Index
+	}
+}
+
+// isRange reports whether the rule selects the files Index to Through
+func (r FileRule) isRange() bool {
+	return r.Glob == "" && r.Ext == "" && r.Index >= 0 && r.Through >= r.Index
+}
+
+// applyRules updates prios in place from rules, in order. On error prios
+// may be partly updated, so callers pass a copy.
+func applyRules(info *TorrentInfo, prios []Priority, rules []FileRule) error {
+	for _, r := range rules {
+		if r.Glob != "" {
+			if _, err := path.Match(r.Glob, ""); err != nil {
+				return fmt.Errorf("invalid file glob %q: %v", r.Glob, err)
+			}
+		}
+		if r.Glob == "" && r.Ext == "" && !r.isRange() && (r.Index < 0 || r.Index >= len(prios)) {
+			return fmt.Errorf("file index %d out of range, torrent has %d files", r.Index, len(prios))
+		}
+
+		targets := info.Files
+		if r.Glob == "" && r.Ext != "" {
+			targets = info.FilesByExt[strings.TrimPrefix(r.Ext, ".")]
+		}
+		for _, f := range targets {
+			if r.matches(f) {
+				prios[f.Index] = r.Priority
+			}
+		}
+	}
+	return nil
+}
+
+// piecePriority maps a file priority onto anacrolix, which has a single tier
+// below high, so low files are held back until the others finish
+func piecePriority(p Priority, deferLow bool) types.PiecePriority {
+	switch p {
+	case PriorityHigh:
+		return types.PiecePriorityHigh
+	case PriorityNormal:
+		return types.PiecePriorityNormal
+	case PriorityLow:
+		if deferLow {
+			return types.PiecePriorityNone
+		}
+		return types.PiecePriorityNormal
+	default:
+		return types.PiecePriorityNone
+	}
+}
+
+// SetFilePriorities applies rules to the torrent files. Before metadata
+// arrives the rules are queued and applied once the file list is known.
+func (h *Handle) SetFilePriorities(rules ...FileRule) error {
+	h.mu.Lock()
+	if h.priorities == nil {
+		h.pendingRules = append(h.pendingRules, rules...)
+		h.mu.Unlock()
+		return nil
+	}
+	h.mu.Unlock()
+
+	info, err := GetTorrentInfo(h.tor)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	prios := append([]Priority(nil), h.priorities...)
+	if err := applyRules(info, prios, rules); err != nil {
+		h.mu.Unlock()
+		return err
+	}
+	h.priorities = prios
+	h.mu.Unlock()
+
+	h.applyPriorities()
+	return h.save()
+}
+
+// SetFilePriority sets the priority of a single file by index
+func (h *Handle) SetFilePriority(index int, p Priority) error {
+	return h.SetFilePriorities(FileRule{Index: index, Priority: p})
+}
+
+// FilePriorities returns the priority of every file, nil before metadata arrives
+func (h *Handle) FilePriorities() []Priority {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Priority(nil), h.priorities...)
+}
+
+// Files returns the torrent file list with the current priorities
+func (h *Handle) Files() ([]FileInfo, error) {
+	info, err := GetTorrentInfo(h.tor)
+	if err != nil {
+		return nil, err
+	}
+	prios := h.FilePriorities()
+	for i := range info.Files {
+		if i < len(prios) {
+			info.Files[i].Priority = prios[i]
+		}
+		info.Files[i].Sequential = h.FileSequential(i)
+	}
+	return info.Files, nil
+}
+
+// initPriorities settles the file priorities once metadata is known, keeping
+// restored values and applying rules queued before the file list existed
+func (h *Handle) initPriorities() error {
+	info, err := GetTorrentInfo(h.tor)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.priorities) != len(info.Files) {
+		h.priorities = make([]Priority, len(info.Files))
+		for i := range h.priorities {
+			h.priorities[i] = PriorityNormal
+		}
+	}
+	rules := h.pendingRules
+	h.pendingRules = nil
+	prios := append([]Priority(nil), h.priorities...)
+	if err := applyRules(info, prios, rules); err != nil {
+		return err
+	}
+	h.priorities = prios
+	return nil
+}
+
+// applyPriorities pushes the file priorities to anacrolix
+func (h *Handle) applyPriorities() {
+	prios := h.FilePriorities()
+	files := h.tor.Files()
+	if len(prios) != len(files) {
+		return
+	}
+
+	deferLow := false
+	for i, f := range files {
+		if prios[i] >= PriorityNormal && f.BytesCompleted() < f.Length() {
+			deferLow = true
+			break
+		}
+	}
+	for i, f := range files {
+		f.SetPriority(piecePriority(prios[i], deferLow))
+	}
+	h.applySequential()
+}
+
+// hasLowFiles reports whether any file waits on the others to finish
+func (h *Handle) hasLowFiles() bool {
+	for _, p := range h.FilePriorities() {
+		if p == PriorityLow {
+			return true
+		}
+	}
+	return false
+}
+
+// wantedComplete reports whether every file not skipped is fully downloaded
+func (h *Handle) wantedComplete() bool {
+	return filesComplete(h.tor, h.FilePriorities())
+}
+
+// filesComplete reports whether every file of tor not skipped in prios is done
+func filesComplete(tor *torrent.Torrent, prios []Priority) bool {
+	for i, f := range tor.Files() {
+		if i < len(prios) && prios[i] != PrioritySkip && f.BytesCompleted() < f.Length() {
+			return false
+		}
+	}
+	return true
+}
+
+// selectFiles applies rules on top of downloading every file, for one-shot
+// downloads that have no Handle to hold the priorities
+func selectFiles(tor *torrent.Torrent, rules []FileRule) ([]Priority, error) {
+	info, err := GetTorrentInfo(tor)
+	if err != nil {
+		return nil, err
+	}
+	prios := make([]Priority, len(info.Files))
+	for i := range prios {
+		prios[i] = PriorityNormal
+	}
+	if err := applyRules(info, prios, rules); err != nil {
+		return nil, err
+	}
+	for i, f := range tor.Files() {
+		f.SetPriority(piecePriority(prios[i], false))
+	}
+	return prios, nil
+}
@@ -0,0 +1,85 @@
+package torrent
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ipRange is an inclusive range of addresses from a range list
+type ipRange struct {
+	first, last netip.Addr
+	value       string
+}
+
+// GeoIP maps addresses to country codes
+type GeoIP struct {
+	ranges []ipRange
+}
+
+// LoadGeoIP reads a CSV of "first IP,last IP,country code" lines. Lines that
+// do not parse, such as headers, are skipped.
+func LoadGeoIP(path string) (*GeoIP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database: %v", err)
+	}
+	defer f.Close()
+
+	var ranges []ipRange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) < 3 {
+			continue
+		}
+		first, err1 := netip.ParseAddr(strings.Trim(fields[0], `" `))
+		last, err2 := netip.ParseAddr(strings.Trim(fields[1], `" `))
+		if err1 != nil || err2 != nil || first.Is4() != last.Is4() {
+			continue
+		}
+		ranges = append(ranges, ipRange{
+			first: first,
+			last:  last,
+			value: strings.ToUpper(strings.Trim(fields[2], `" `)),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read GeoIP database: %v", err)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first.Less(ranges[j].first)
+	})
+	return &GeoIP{ranges: ranges}, nil
+}
+
+// Country returns the country code of addr, empty when unknown
+func (g *GeoIP) Country(addr netip.Addr) string {
+	if g == nil {
+		return ""
+	}
+	if r, ok := findRange(g.ranges, addr.Unmap()); ok {
+		return r.value
+	}
+	return ""
+}
+
+// findRange returns the range in sorted ranges that holds addr
+func findRange(ranges []ipRange, addr netip.Addr) (ipRange, bool) {
+	// The first range starting after addr, the candidate is the one before it
+	i := sort.Search(len(ranges), func(i int) bool {
+		return addr.Less(ranges[i].first)
+	})
+	if i == 0 {
+		return ipRange{}, false
+	}
+	r := ranges[i-1]
+	if r.first.Is4() != addr.Is4() || r.last.Less(addr) {
+		return ipRange{}, false
+	}
+	return r, true
+}
@@ -0,0 +1,334 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// hookOutputLimit caps how much of a command's output is logged
+const hookOutputLimit = 64 << 10
+
+// Hook runs an external command when a session event matches, such as
+// unpacking archives once a torrent completes. Every element of Command is
+// a text/template over HookData, for example ["unrar", "x", "{{.File}}"].
+// The same values are passed in ZTORRENT_* environment variables.
+type Hook struct {
+	Events         []EventType `json:"events"`
+	Command        []string    `json:"command"`         // program and arguments
+	Labels         []string    `json:"labels"`          // only torrents carrying one of these, empty for all
+	TimeoutSeconds int         `json:"timeout_seconds"` // zero uses hook_timeout_seconds
+}
+
+// HookData is what hook templates and environment variables can use
+type HookData struct {
+	Event    EventType
+	Name     string
+	InfoHash string
+	SavePath string
+	Label    string // every label, comma separated
+	Labels   []string
+	Files    []string // absolute paths of the selected files
+	File     string   // absolute path of the completed file for file_completed
+	Ratio    float64
+	Peer     string // banned address for peer_banned
+	Message  string // tracker error, disk error, ban reason or seed goal reason
+}
+
+// Validate reports an unknown event type
+func (t EventType) Validate() error {
+	switch t {
+	case EventTorrentAdded, EventMetadata, EventStateChanged, EventFileCompleted,
+		EventTorrentCompleted, EventTrackerError, EventPeerBanned, EventDiskError, EventSeedGoal:
+		return nil
+	}
+	return fmt.Errorf("unknown event %q", t)
+}
+
+// Validate rejects hooks that could never run
+func (hk Hook) Validate() error {
+	if len(hk.Events) == 0 {
+		return fmt.Errorf("hook %q has no events", strings.Join(hk.Command, " "))
+	}
+	for _, t := range hk.Events {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+	}
+	if len(hk.Command) == 0 || hk.Command[0] == "" {
+		return fmt.Errorf("hook for %v has no command", hk.Events)
+	}
+	if hk.TimeoutSeconds < 0 {
+		return fmt.Errorf("hook timeout_seconds cannot be negative")
+	}
+	_, err := parseHookCommand(hk.Command)
+	return err
+}
+
+var hookFuncs = template.FuncMap{
+	"join": strings.Join,
+	"base": filepath.Base,
+	"dir":  filepath.Dir,
+}
+
+// parseHookCommand compiles every argument of a hook command
+func parseHookCommand(command []string) ([]*template.Template, error) {
+	args := make([]*template.Template, len(command))
+	for i, arg := range command {
+		t, err := template.New(strconv.Itoa(i)).Funcs(hookFuncs).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("hook argument %q: %v", arg, err)
+		}
+		args[i] = t
+	}
+	return args, nil
+}
+
+// matches reports whether hk runs for an event of type t on a torrent with labels
+func (hk Hook) matches(t EventType, labels []string) bool {
+	found := false
+	for _, want := range hk.Events {
+		if want == t {
+			found = true
+			break
+		}
+	}
+	if !found || len(hk.Labels) == 0 {
+		return found
+	}
+	for _, want := range hk.Labels {
+		for _, l := range labels {
+			if strings.EqualFold(want, l) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// env returns d as ZTORRENT_* environment variables
+func (d HookData) env() []string {
+	return []string{
+		"ZTORRENT_EVENT=" + string(d.Event),
+		"ZTORRENT_NAME=" + d.Name,
+		"ZTORRENT_INFOHASH=" + d.InfoHash,
+		"ZTORRENT_SAVE_PATH=" + d.SavePath,
+		"ZTORRENT_LABEL=" + d.Label,
+		"ZTORRENT_FILES=" + strings.Join(d.Files, "\n"),
+		"ZTORRENT_FILE=" + d.File,
+		"ZTORRENT_RATIO=" + strconv.FormatFloat(d.Ratio, 'f', 2, 64),
+		"ZTORRENT_PEER=" + d.Peer,
+		"ZTORRENT_MESSAGE=" + d.Message,
+	}
+}
+
+// hookData collects what hooks see of e, looked up when it happens so
+// torrents removed right after still have their details
+func (s *Session) hookData(e Event) HookData {
+	head := e.Header()
+	d := HookData{Event: e.Type(), Name: head.Name, InfoHash: head.InfoHash}
+
+	if h, ok := s.Torrent(head.InfoHash); ok {
+		d.SavePath = h.SavePath()
+		d.Labels = h.Labels()
+		d.Label = strings.Join(d.Labels, ",")
+		d.Ratio = h.Ratio()
+		// Magnets have no file list until their metadata arrives
+		if h.tor.Info() != nil {
+			prios := h.FilePriorities()
+			for i, f := range h.tor.Files() {
+				if i < len(prios) && prios[i] == PrioritySkip {
+					continue
+				}
+				d.Files = append(d.Files, filepath.Join(d.SavePath, f.Path()))
+			}
+		}
+	}
+
+	switch e := e.(type) {
+	case FileCompletedEvent:
+		d.File = filepath.Join(d.SavePath, e.Path)
+	case TorrentCompletedEvent:
+		d.SavePath = e.SavePath
+	case TrackerErrorEvent:
+		d.Message = e.Tracker + ": " + e.Message
+	case PeerBannedEvent:
+		d.Peer = e.Ban.Addr.String()
+		d.Message = e.Ban.Reason
+	case DiskErrorEvent:
+		d.Message = e.Err.Error()
+	case SeedGoalEvent:
+		d.Message = e.Reason
+	}
+	return d
+}
+
+// compiledHook is a Hook with its command templates parsed
+type compiledHook struct {
+	Hook
+	args []*template.Template
+}
+
+// hookLoop runs the configured hooks for every matching event until the
+// session closes, which stops commands still running. Commands run in the
+// background, at most max_hook_jobs at once, so a slow one only delays
+// other hooks.
+func (s *Session) hookLoop(sub *Subscription) {
+	defer s.wg.Done()
+	defer sub.Close()
+
+	hooks := make([]compiledHook, 0, len(s.config.Hooks))
+	for _, hk := range s.config.Hooks {
+		args, _ := parseHookCommand(hk.Command)
+		hooks = append(hooks, compiledHook{Hook: hk, args: args})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var slots chan struct{}
+	if n := s.config.MaxHookJobs; n > 0 {
+		slots = make(chan struct{}, n)
+	}
+
+	var dropped int64
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			var labels []string
+			if h, ok := s.Torrent(e.Header().InfoHash); ok {
+				labels = h.Labels()
+			}
+			var data *HookData
+			for _, hk := range hooks {
+				if !hk.matches(e.Type(), labels) {
+					continue
+				}
+				if data == nil {
+					d := s.hookData(e)
+					data = &d
+				}
+				s.wg.Add(1)
+				go s.runHook(ctx, slots, hk, *data)
+			}
+			if n := sub.Dropped(); n > dropped {
+				s.logf("hooks fell behind, %d events were skipped", n-dropped)
+				dropped = n
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// runHook waits for a free slot, runs the command and logs its output
+func (s *Session) runHook(ctx context.Context, slots chan struct{}, hk compiledHook, data HookData) {
+	defer s.wg.Done()
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	args := make([]string, len(hk.args))
+	for i, t := range hk.args {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			s.logf("hook %s for %s: %v", data.Event, data.Name, err)
+			return
+		}
+		args[i] = buf.String()
+	}
+
+	timeout := time.Duration(hk.TimeoutSeconds) * time.Second
+	if timeout == 0 {
+		timeout = time.Duration(s.config.HookTimeoutSeconds) * time.Second
+	}
+	runCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	out := &limitedBuffer{limit: hookOutputLimit}
+	cmd := exec.CommandContext(runCtx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), data.env()...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	// Output pipes of orphaned children must not keep the hook waiting
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err := cmd.Run()
+	took := time.Since(start).Round(time.Millisecond)
+	switch {
+	case runCtx.Err() == context.DeadlineExceeded:
+		s.logf("hook %s for %s: %q timed out after %s", data.Event, data.Name, args, took)
+	case err != nil:
+		s.logf("hook %s for %s: %q failed after %s: %v", data.Event, data.Name, args, took, err)
+	default:
+		s.logf("hook %s for %s: %q finished in %s", data.Event, data.Name, args, took)
+	}
+	for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+		if line != "" {
+			s.logf("  | %s", line)
+		}
+	}
+	if out.truncated {
+		s.logf("  | (output truncated)")
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// openLog opens the session log, log_file or ztorrent.log in the state directory
+func (s *Session) openLog() error {
+	path := s.config.LogFile
+	if path == "" {
+		path = filepath.Join(s.stateDir, "ztorrent.log")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %v", err)
+	}
+	s.logFile = f
+	s.logger = log.New(f, "", log.LstdFlags)
+	return nil
+}
+
+// logf writes a line to the session log, if one is open
+func (s *Session) logf(format string, args ...any) {
+	if s.logger != nil {
+		s.logger.Printf(format, args...)
+	}
+}
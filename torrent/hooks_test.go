@@ -0,0 +1,50 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookOnMagnetWithoutMetadata(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "hook.out")
+
+	conf := DefaultConfig()
+	conf.StateDir = filepath.Join(dir, "state")
+	conf.Hooks = []Hook{{
+		Events:  []EventType{EventTorrentAdded},
+		Command: []string{"sh", "-c", `printf '%s|%s' "$ZTORRENT_INFOHASH" "$ZTORRENT_FILES" > "$0"`, out},
+	}}
+	s, err := NewSession(conf, filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	const infoHash = "0123456789abcdef0123456789abcdef01234567"
+	h, err := s.AddMagnet("magnet:?xt=urn:btih:"+infoHash, AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.tor.Info() != nil {
+		t.Fatal("magnet has metadata without any peer")
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		data, err := os.ReadFile(out)
+		if err == nil && strings.Contains(string(data), "|") {
+			if got, want := string(data), infoHash+"|"; got != want {
+				t.Errorf("hook wrote %q, want %q", got, want)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hook did not run for the magnet")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,254 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// minBurst is the largest block peers request, anacrolix panics when an
+	// upload limiter cannot cover one
+	minBurst = 16 << 10
+	// throttleInterval is how often per torrent limits are enforced
+	throttleInterval = 250 * time.Millisecond
+)
+
+// Limits holds transfer limits in bytes per second, zero is unlimited
+type Limits struct {
+	Download int64 `json:"download"`
+	Upload   int64 `json:"upload"`
+}
+
+// Validate rejects negative limits
+func (l Limits) Validate() error {
+	if l.Download < 0 || l.Upload < 0 {
+		return fmt.Errorf("rate limits cannot be negative")
+	}
+	return nil
+}
+
+// bandwidth holds the client wide limiters handed to anacrolix, which stay
+// the same objects for the client lifetime so limits can change at runtime
+type bandwidth struct {
+	mu       sync.Mutex
+	down, up *rate.Limiter
+	normal   Limits
+	alt      Limits
+	altOn    bool
+
+	// profile names the scheduled limits replacing normal, empty when none
+	profile   string
+	scheduled Limits
+}
+
+// newBandwidth returns limiters set from the normal and alt limits of conf
+func newBandwidth(conf Config) *bandwidth {
+	b := &bandwidth{
+		down:   rate.NewLimiter(rate.Inf, minBurst),
+		up:     rate.NewLimiter(rate.Inf, minBurst),
+		normal: conf.Limits,
+		alt:    conf.AltLimits,
+	}
+	b.apply()
+	return b
+}
+
+// active returns the limits currently in force, alt speed mode overrides
+// the schedule which overrides the normal limits
+func (b *bandwidth) active() Limits {
+	switch {
+	case b.altOn:
+		return b.alt
+	case b.profile != "":
+		return b.scheduled
+	}
+	return b.normal
+}
+
+// apply pushes the active limits to the limiters. The caller must hold b.mu
+// or own b exclusively.
+func (b *bandwidth) apply() {
+	l := b.active()
+	setLimit(b.down, l.Download)
+	setLimit(b.up, l.Upload)
+}
+
+// setLimit changes l in place. The burst is raised before the limit so
+// anacrolix never sees a finite limit with a burst below one block.
+func setLimit(l *rate.Limiter, bps int64) {
+	if bps <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	burst := int(bps)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	l.SetBurst(burst)
+	l.SetLimit(rate.Limit(bps))
+}
+
+// SetLimits changes the global limits used outside alt speed mode
+func (s *Session) SetLimits(l Limits) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	s.bandwidth.mu.Lock()
+	defer s.bandwidth.mu.Unlock()
+	s.bandwidth.normal = l
+	s.bandwidth.apply()
+	return nil
+}
+
+// SetAltLimits changes the global limits used in alt speed mode
+func (s *Session) SetAltLimits(l Limits) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	s.bandwidth.mu.Lock()
+	defer s.bandwidth.mu.Unlock()
+	s.bandwidth.alt = l
+	s.bandwidth.apply()
+	return nil
+}
+
+// SetAltSpeed switches between the normal and alt speed limits
+func (s *Session) SetAltSpeed(on bool) {
+	s.bandwidth.mu.Lock()
+	defer s.bandwidth.mu.Unlock()
+	s.bandwidth.altOn = on
+	s.bandwidth.apply()
+}
+
+// ToggleAltSpeed flips alt speed mode and returns the new state
+func (s *Session) ToggleAltSpeed() bool {
+	s.bandwidth.mu.Lock()
+	defer s.bandwidth.mu.Unlock()
+	s.bandwidth.altOn = !s.bandwidth.altOn
+	s.bandwidth.apply()
+	return s.bandwidth.altOn
+}
+
+// AltSpeed reports whether alt speed mode is on
+func (s *Session) AltSpeed() bool {
+	s.bandwidth.mu.Lock()
+	defer s.bandwidth.mu.Unlock()
+	return s.bandwidth.altOn
+}
+
+// Limits returns the global limits currently in force
+func (s *Session) Limits() Limits {
+	s.bandwidth.mu.Lock()
+	defer s.bandwidth.mu.Unlock()
+	return s.bandwidth.active()
+}
+
+// throttle is a token bucket over a cumulative byte counter. anacrolix only
+// limits the whole client, so a torrent over its own limit is held by
+// disallowing its transfers until the bucket refills.
+type throttle struct {
+	last   int64
+	tokens float64
+	primed bool
+}
+
+// update feeds the latest counter value and reports whether to hold transfers
+func (t *throttle) update(total, limit int64, dt time.Duration) bool {
+	if limit <= 0 || !t.primed {
+		t.last = total
+		t.tokens = float64(limit)
+		t.primed = limit > 0
+		return false
+	}
+	t.tokens += float64(limit) * dt.Seconds()
+	if t.tokens > float64(limit) {
+		t.tokens = float64(limit)
+	}
+	t.tokens -= float64(total - t.last)
+	t.last = total
+	return t.tokens < 0
+}
+
+// SetLimits changes the limits of this torrent, on top of the global ones
+func (h *Handle) SetLimits(l Limits) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.limits = l
+	h.mu.Unlock()
+	return h.save()
+}
+
+// Limits returns the limits of this torrent
+func (h *Handle) Limits() Limits {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.limits
+}
+
+// throttle updates the token buckets of h and holds or releases its transfers
+func (h *Handle) throttle(dt time.Duration) {
+	stats := h.tor.Stats()
+
+	h.mu.Lock()
+	down := h.downThrottle.update(stats.BytesReadData.Int64(), h.limits.Download, dt)
+	up := h.upThrottle.update(stats.BytesWrittenData.Int64(), h.limits.Upload, dt)
+	changed := down != h.downHeld || up != h.upHeld
+	h.downHeld, h.upHeld = down, up
+	h.mu.Unlock()
+
+	if changed {
+		h.updateTransfer()
+	}
+}
+
+// updateTransfer allows or disallows data transfer from every reason the
+// torrent may be held
+func (h *Handle) updateTransfer() {
+	offline := h.session.iface.down()
+	h.mu.Lock()
+	down := !h.paused && !h.queued && !h.moving && !h.checking && !h.downHeld && !h.seedOnly && !h.allocating && !offline
+	up := !h.paused && !h.queued && !h.moving && !h.checking && !h.upHeld && !offline
+	h.mu.Unlock()
+
+	setAllowed(h.tor, down, up)
+}
+
+func setAllowed(tor *torrent.Torrent, down, up bool) {
+	if down {
+		tor.AllowDataDownload()
+	} else {
+		tor.DisallowDataDownload()
+	}
+	if up {
+		tor.AllowDataUpload()
+	} else {
+		tor.DisallowDataUpload()
+	}
+}
+
+// throttleLoop enforces per torrent limits until the session closes
+func (s *Session) throttleLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(throttleInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			dt := now.Sub(last)
+			last = now
+			for _, h := range s.Torrents() {
+				h.throttle(dt)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/anacrolix/torrent"
+	"github.com/serene-brew/ztorrent/bencode"
+)
+
+// MetadataFetcher resolves magnet links to their metainfo through one
+// client, so many links can be fetched side by side. Nothing is written
+// to disk.
+type MetadataFetcher struct {
+	client *torrent.Client
+}
+
+// NewMetadataFetcher creates a fetcher with the network settings of conf
+func NewMetadataFetcher(conf Config) (*MetadataFetcher, error) {
+	conf.Storage = StorageMemory
+	conf.Seed = false
+	client, _, err := createTorrentClient(conf, "", nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("client creation failed: %v", err)
+	}
+	return &MetadataFetcher{client: client}, nil
+}
+
+// Fetch waits for the metainfo of magnetURI from peers until ctx is done.
+// Trackers of the magnet link end up in the announce list of the result.
+func (f *MetadataFetcher) Fetch(ctx context.Context, magnetURI string) (bencode.Torrent, error) {
+	tor, err := f.client.AddMagnet(magnetURI)
+	if err != nil {
+		return bencode.Torrent{}, fmt.Errorf("failed to add magnet: %v", err)
+	}
+	defer tor.Drop()
+	tor.DisallowDataDownload()
+
+	select {
+	case <-tor.GotInfo():
+	case <-ctx.Done():
+		return bencode.Torrent{}, fmt.Errorf("no metadata for %s: %v", tor.InfoHash().HexString(), ctx.Err())
+	}
+
+	var buf bytes.Buffer
+	mi := tor.Metainfo()
+	if err := mi.Write(&buf); err != nil {
+		return bencode.Torrent{}, fmt.Errorf("failed to encode metadata: %v", err)
+	}
+	return bencode.ParseTorrent(buf.Bytes())
+}
+
+// Close shuts down the client of the fetcher
+func (f *MetadataFetcher) Close() {
+	f.client.Close()
+}
+
+// FetchMetadata resolves a single magnet link to its metainfo with a
+// fetcher configured by conf
+func FetchMetadata(ctx context.Context, conf Config, magnetURI string) (bencode.Torrent, error) {
+	f, err := NewMetadataFetcher(conf)
+	if err != nil {
+		return bencode.Torrent{}, err
+	}
+	defer f.Close()
+	return f.Fetch(ctx, magnetURI)
+}
@@ -0,0 +1,311 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// movableStorage is the storage of a single torrent whose directory can
+// change while the torrent runs. Pieces look up the current backing storage
+// on every access, so anacrolix keeps working across a move.
+type movableStorage struct {
+	open func(dir string) (storage.ClientImpl, error)
+
+	mu       sync.RWMutex
+	dir      string
+	info     *metainfo.Info
+	infoHash metainfo.Hash
+	inner    *storage.TorrentImpl
+}
+
+func newMovableStorage(dir string, open func(dir string) (storage.ClientImpl, error)) *movableStorage {
+	return &movableStorage{dir: dir, open: open}
+}
+
+// OpenTorrent implements storage.ClientImpl
+func (m *movableStorage) OpenTorrent(ctx context.Context, info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	impl, err := m.open(m.dir)
+	if err != nil {
+		return storage.TorrentImpl{}, err
+	}
+	inner, err := impl.OpenTorrent(ctx, info, infoHash)
+	if err != nil {
+		return storage.TorrentImpl{}, err
+	}
+	m.info, m.infoHash, m.inner = info, infoHash, &inner
+
+	return storage.TorrentImpl{
+		PieceWithHash: func(p metainfo.Piece, hash g.Option[[]byte]) storage.PieceImpl {
+			return movablePiece{m, p, hash}
+		},
+		Close: func() error {
+			return m.current().Close()
+		},
+		Flush: m.flush,
+	}, nil
+}
+
+func (m *movableStorage) current() *storage.TorrentImpl {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.inner
+}
+
+func (m *movableStorage) flush() error {
+	if inner := m.current(); inner != nil && inner.Flush != nil {
+		return inner.Flush()
+	}
+	return nil
+}
+
+// relocate points the storage at dir, where the data must already be
+func (m *movableStorage) relocate(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.inner == nil {
+		m.dir = dir
+		return nil
+	}
+	impl, err := m.open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open storage in %s: %v", dir, err)
+	}
+	inner, err := impl.OpenTorrent(context.Background(), m.info, m.infoHash)
+	if err != nil {
+		return fmt.Errorf("failed to open storage in %s: %v", dir, err)
+	}
+	old := m.inner
+	m.dir, m.inner = dir, &inner
+	if old.Close != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// movablePiece forwards to the piece of the current backing storage
+type movablePiece struct {
+	m    *movableStorage
+	p    metainfo.Piece
+	hash g.Option[[]byte]
+}
+
+func (mp movablePiece) piece() storage.PieceImpl {
+	inner := mp.m.current()
+	if inner.PieceWithHash != nil {
+		return inner.PieceWithHash(mp.p, mp.hash)
+	}
+	return inner.Piece(mp.p)
+}
+
+func (mp movablePiece) ReadAt(b []byte, off int64) (int, error)  { return mp.piece().ReadAt(b, off) }
+func (mp movablePiece) WriteAt(b []byte, off int64) (int, error) { return mp.piece().WriteAt(b, off) }
+func (mp movablePiece) MarkComplete() error                      { return mp.piece().MarkComplete() }
+func (mp movablePiece) MarkNotComplete() error                   { return mp.piece().MarkNotComplete() }
+func (mp movablePiece) Completion() storage.Completion           { return mp.piece().Completion() }
+
+// MoveStorage moves the torrent data under newPath and keeps the torrent
+// running from there. Transfers are held during the move. A rename is used
+// when possible, otherwise the data is copied and the original removed; a
+// failed copy is rolled back and leaves the torrent where it was. Once the
+// torrent runs from newPath the move has succeeded; an original that cannot
+// be removed is only logged.
+func (h *Handle) MoveStorage(newPath string) error {
+	newPath, err := filepath.Abs(newPath)
+	if err != nil {
+		return fmt.Errorf("invalid path: %v", err)
+	}
+
+	h.mu.Lock()
+	if h.moving {
+		h.mu.Unlock()
+		return fmt.Errorf("torrent %s is already being moved", h.InfoHash())
+	}
+	if !h.storageKind.movable() {
+		h.mu.Unlock()
+		return fmt.Errorf("torrent %s uses %s storage, which cannot be moved", h.InfoHash(), h.storageKind)
+	}
+	oldPath := h.savePath
+	h.moving = true
+	h.moveDone, h.moveTotal = 0, 0
+	h.mu.Unlock()
+	h.updateTransfer()
+
+	err = h.moveData(oldPath, newPath)
+
+	h.mu.Lock()
+	h.moving = false
+	if err == nil {
+		h.savePath = newPath
+	}
+	h.mu.Unlock()
+	h.updateTransfer()
+
+	if err != nil {
+		return err
+	}
+	return h.save()
+}
+
+// MoveProgress returns the bytes copied so far by a running move, zero
+// totals when no copy is in progress
+func (h *Handle) MoveProgress() (done, total int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.moveDone, h.moveTotal
+}
+
+func (h *Handle) moveData(oldPath, newPath string) error {
+	if filepath.Clean(oldPath) == newPath {
+		return nil
+	}
+	if err := os.MkdirAll(newPath, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", newPath, err)
+	}
+	h.storage.flush()
+
+	info := h.tor.Info()
+	if info == nil {
+		// Nothing is on disk before metadata arrives
+		return h.storage.relocate(newPath)
+	}
+	src := filepath.Join(oldPath, info.BestName())
+	dst := filepath.Join(newPath, info.BestName())
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return h.storage.relocate(newPath)
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+
+	err := os.Rename(src, dst)
+	if err == nil {
+		if err := h.storage.relocate(newPath); err != nil {
+			os.Rename(dst, src)
+			return err
+		}
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("failed to move data: %v", err)
+	}
+
+	// Across filesystems: copy beside the destination and rename into
+	// place, so the destination never holds a partial tree
+	tmp := filepath.Join(newPath, "."+info.BestName()+".ztorrent-move")
+	os.RemoveAll(tmp)
+	if err := h.copyTree(src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("failed to copy data: %v", err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("failed to move data: %v", err)
+	}
+	if err := h.storage.relocate(newPath); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	// The torrent now reads from dst, so a leftover source is not a failed move
+	if err := os.RemoveAll(src); err != nil {
+		h.session.logf("move %s: failed to remove %s: %v", h.Name(), src, err)
+	}
+	return nil
+}
+
+// copyTree copies the file or directory src to dst, counting bytes towards
+// the move progress of h
+func (h *Handle) copyTree(src, dst string) error {
+	var total int64
+	filepath.WalkDir(src, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				total += fi.Size()
+			}
+		}
+		return nil
+	})
+	h.mu.Lock()
+	h.moveTotal = total
+	h.mu.Unlock()
+
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm())
+		case d.Type().IsRegular():
+			return h.copyFile(path, target, fi.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+func (h *Handle) copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, &moveCounter{in, h}); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// moveCounter adds the bytes read through it to the move progress
+type moveCounter struct {
+	r io.Reader
+	h *Handle
+}
+
+func (c *moveCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.mu.Lock()
+	c.h.moveDone += int64(n)
+	c.h.mu.Unlock()
+	return n, err
+}
+
+// completeDir returns where finished torrents are moved to
+func (s *Session) completeDir() string {
+	if s.config.CompleteDir != "" {
+		return s.config.CompleteDir
+	}
+	return s.dataDir
+}
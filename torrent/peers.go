@@ -0,0 +1,331 @@
+package torrent
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	pp "github.com/anacrolix/torrent/peer_protocol"
+)
+
+// peerState is what we learn about a connection from the messages it sends.
+// anacrolix keeps its per connection stats and flags private, so they are
+// rebuilt from callbacks: downloads count received piece data. There is no
+// callback for messages we write, so uploads are credited from the piece
+// data the torrent sent, see creditUploads.
+type peerState struct {
+	downloaded int64
+	uploaded   int64
+	pending    int64 // requested from us and neither cancelled nor credited yet
+	choking    bool
+	interested bool
+	infoHash   string // hex, set once the handshake completes
+}
+
+var peerStates = struct {
+	sync.Mutex
+	m map[*torrent.PeerConn]*peerState
+	// sent holds who sent data for each piece not hashed yet, so a failed
+	// hash can be blamed even after the connection is gone. Only torrents
+	// in recording, counted by the watchers reading the verdicts, are kept.
+	sent      map[pieceKey]map[string]netip.Addr
+	recording map[string]int
+}{
+	m:         make(map[*torrent.PeerConn]*peerState),
+	sent:      make(map[pieceKey]map[string]netip.Addr),
+	recording: make(map[string]int),
+}
+
+type pieceKey struct {
+	infoHash string
+	index    int
+}
+
+// notePeerTorrent is installed as the CompletedHandshake callback of every client
+func notePeerTorrent(pc *torrent.PeerConn, ih metainfo.Hash) {
+	peerStates.Lock()
+	defer peerStates.Unlock()
+
+	c, ok := peerStates.m[pc]
+	if !ok {
+		c = &peerState{choking: true}
+		peerStates.m[pc] = c
+	}
+	c.infoHash = ih.HexString()
+}
+
+// countPeerMessage is installed as the ReadMessage callback of every client
+func countPeerMessage(pc *torrent.PeerConn, msg *pp.Message) {
+	if msg.Keepalive {
+		return
+	}
+
+	peerStates.Lock()
+	defer peerStates.Unlock()
+
+	c, ok := peerStates.m[pc]
+	if !ok {
+		// Every connection starts choked and not interested
+		c = &peerState{choking: true}
+		peerStates.m[pc] = c
+	}
+	switch msg.Type {
+	case pp.Piece:
+		c.downloaded += int64(len(msg.Piece))
+		if addr, ok := peerAddr(pc); ok && peerStates.recording[c.infoHash] > 0 {
+			key := pieceKey{c.infoHash, int(msg.Index)}
+			if peerStates.sent[key] == nil {
+				peerStates.sent[key] = make(map[string]netip.Addr)
+			}
+			peerStates.sent[key][pc.RemoteAddr.String()] = addr
+		}
+	case pp.Request:
+		c.pending += int64(msg.Length)
+	case pp.Cancel:
+		c.pending = max(c.pending-int64(msg.Length), 0)
+	case pp.Choke:
+		c.choking = true
+	case pp.Unchoke:
+		c.choking = false
+	case pp.Interested:
+		c.interested = true
+	case pp.NotInterested:
+		c.interested = false
+	}
+}
+
+// forgetPeer is installed as the PeerConnClosed callback of every client
+func forgetPeer(pc *torrent.PeerConn) {
+	peerStates.Lock()
+	defer peerStates.Unlock()
+	delete(peerStates.m, pc)
+}
+
+// peerTraffic returns the payload bytes received from and sent to pc
+func peerTraffic(pc *torrent.PeerConn) (down, up int64) {
+	peerStates.Lock()
+	defer peerStates.Unlock()
+	if c, ok := peerStates.m[pc]; ok {
+		return c.downloaded, c.uploaded
+	}
+	return 0, 0
+}
+
+// creditUploads hands n bytes of piece data the torrent sent to its peers
+// conns. anacrolix counts the payload of the Piece messages it writes per
+// torrent only, so each peer gets a share of n weighted by the data it is
+// still waiting on, never more. Requests we drop by choking the peer are
+// not reported to us and only sway the weights, so the credited total
+// never exceeds what was actually sent.
+func creditUploads(conns []*torrent.PeerConn, n int64) {
+	if n <= 0 {
+		return
+	}
+	peerStates.Lock()
+	defer peerStates.Unlock()
+
+	var waiting []*peerState
+	var total int64
+	for _, pc := range conns {
+		if c, ok := peerStates.m[pc]; ok && c.pending > 0 {
+			waiting = append(waiting, c)
+			total += c.pending
+		}
+	}
+	if total == 0 {
+		return
+	}
+	for _, c := range waiting {
+		share := c.pending
+		if n < total {
+			share = int64(float64(n) * float64(c.pending) / float64(total))
+		}
+		c.uploaded += share
+		c.pending -= share
+	}
+}
+
+// peerFlags returns whether pc is choking us and whether it is interested in us
+func peerFlags(pc *torrent.PeerConn) (choking, interested bool) {
+	peerStates.Lock()
+	defer peerStates.Unlock()
+	if c, ok := peerStates.m[pc]; ok {
+		return c.choking, c.interested
+	}
+	return true, false
+}
+
+// pieceContributors returns the addresses, with ports, of the peers that
+// sent data for a piece and forgets them, once the piece has been hashed
+func pieceContributors(infoHash string, piece int) map[string]netip.Addr {
+	peerStates.Lock()
+	defer peerStates.Unlock()
+
+	key := pieceKey{infoHash, piece}
+	sent := peerStates.sent[key]
+	delete(peerStates.sent, key)
+	return sent
+}
+
+// recordPieces keeps who sent each piece of a torrent until
+// pieceContributors or forgetPieces is called for it
+func recordPieces(infoHash string) {
+	peerStates.Lock()
+	defer peerStates.Unlock()
+	peerStates.recording[infoHash]++
+}
+
+// forgetPieces undoes a recordPieces call, dropping what is known about the
+// pieces of the torrent once nothing reads the verdicts anymore
+func forgetPieces(infoHash string) {
+	peerStates.Lock()
+	defer peerStates.Unlock()
+	if peerStates.recording[infoHash]--; peerStates.recording[infoHash] > 0 {
+		return
+	}
+	delete(peerStates.recording, infoHash)
+	for key := range peerStates.sent {
+		if key.infoHash == infoHash {
+			delete(peerStates.sent, key)
+		}
+	}
+}
+
+var peerSources = map[torrent.PeerSource]string{
+	torrent.PeerSourceTracker:         "tracker",
+	torrent.PeerSourceIncoming:        "incoming",
+	torrent.PeerSourceDhtGetPeers:     "dht",
+	torrent.PeerSourceDhtAnnouncePeer: "dht",
+	torrent.PeerSourcePex:             "pex",
+	torrent.PeerSourceDirect:          "magnet",
+	torrent.PeerSourceUtHolepunch:     "holepunch",
+}
+
+// peerSourceName maps an anacrolix discovery code to a readable name
+func peerSourceName(src torrent.PeerSource) string {
+	if name, ok := peerSources[src]; ok {
+		return name
+	}
+	return string(src)
+}
+
+// peerNetworkName reports the transport of pc as TCP, uTP or WebRTC
+func peerNetworkName(pc *torrent.PeerConn) string {
+	switch {
+	case strings.HasPrefix(pc.Network, "udp"), strings.HasPrefix(pc.Network, "utp"):
+		return "uTP"
+	case strings.HasPrefix(pc.Network, "tcp"):
+		return "TCP"
+	case pc.Network == "webrtc":
+		return "WebRTC"
+	}
+	return pc.Network
+}
+
+// azureusClients maps the two letter codes of Azureus style peer IDs
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FX": "Freebox",
+	"KT": "KTorrent",
+	"LT": "libtorrent (rakshasa)",
+	"lt": "libtorrent",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UM": "µTorrent Mac",
+	"UW": "µTorrent Web",
+	"WD": "WebTorrent Desktop",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+	"ZT": "ztorrent",
+	"GT": "anacrolix/torrent",
+}
+
+// shadowClients maps the first byte of Shadow style peer IDs
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'M': "Mainline",
+	'O': "Osprey",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+}
+
+// peerClientName prefers the name from the extended handshake and falls back
+// to decoding the peer ID
+func peerClientName(pc *torrent.PeerConn) string {
+	if v, ok := pc.PeerClientName.Load().(string); ok && v != "" {
+		return v
+	}
+	return DecodePeerID(pc.PeerID)
+}
+
+// peerIDVersion decodes the version characters of an Azureus style peer ID.
+// Transmission writes a major digit and a two digit minor, "3000" is 3.00.
+// Others write one character per part, 0-9 then A-Z for 10 to 35, the last
+// being a build number left out when zero: "4250" is 4.2.5, "13F0" is 1.3.15.
+func peerIDVersion(code, v string) string {
+	if code == "TR" && len(v) == 4 {
+		// Before 1.00 the minor took the last two digits, "0072" is 0.72
+		if v[0] == '0' {
+			return "0." + v[2:]
+		}
+		version := v[:1] + "." + v[1:3]
+		if v[3] == 'Z' || v[3] == 'X' {
+			version += "+"
+		}
+		return version
+	}
+
+	parts := make([]string, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c >= '0' && c <= '9':
+			parts = append(parts, string(c))
+		case c >= 'A' && c <= 'Z':
+			parts = append(parts, strconv.Itoa(int(c-'A')+10))
+		default:
+			// Not a convention we know, show it as sent
+			return v
+		}
+	}
+	if len(parts) == 4 && parts[3] == "0" {
+		parts = parts[:3]
+	}
+	return strings.Join(parts, ".")
+}
+
+// DecodePeerID names the client behind a BEP 20 peer ID, e.g. "-qB4250-" is qBittorrent 4.2.5
+func DecodePeerID(id [20]byte) string {
+	if id[0] == '-' && id[7] == '-' {
+		code := string(id[1:3])
+		name, ok := azureusClients[code]
+		if !ok {
+			name = code
+		}
+		version := peerIDVersion(code, strings.TrimRight(string(id[3:7]), "-"))
+		if version == "" {
+			return name
+		}
+		return fmt.Sprintf("%s %s", name, version)
+	}
+	if name, ok := shadowClients[id[0]]; ok {
+		return name
+	}
+	if id == [20]byte{} {
+		return ""
+	}
+	return "unknown"
+}
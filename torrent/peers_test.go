@@ -0,0 +1,34 @@
+package torrent
+
+import "testing"
+
+func TestDecodePeerID(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"-qB4250-", "qBittorrent 4.2.5"},
+		{"-qB4251-", "qBittorrent 4.2.5.1"},
+		{"-TR3000-", "Transmission 3.00"},
+		{"-TR133Z-", "Transmission 1.33+"},
+		{"-TR0072-", "Transmission 0.72"},
+		{"-DE13F0-", "Deluge 1.3.15"},
+		{"-lt0D60-", "libtorrent 0.13.6"},
+		{"-UT355W-", "µTorrent 3.5.5.32"},
+		{"-ZT10---", "ztorrent 1.0"},
+		{"-ZT0001-", "ztorrent 0.0.0.1"},
+		{"-XX1000-", "XX 1.0.0"},
+		{"-GTa1b2-", "anacrolix/torrent a1b2"},
+		{"M7-2-2--", "Mainline"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			var id [20]byte
+			copy(id[:], tt.prefix)
+			if got := DecodePeerID(id); got != tt.want {
+				t.Errorf("DecodePeerID(%q) = %q, want %q", tt.prefix, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/dialer"
+	"github.com/serene-brew/ztorrent/proxy"
+)
+
+// applyProxy routes the proxied categories of cfg through p, reaching the
+// proxy with forward when set, and returns the dialer peers must use, nil
+// when peers connect directly. Tracker host names are left for the proxy to
+// resolve, see trackerNames.
+func applyProxy(cfg *torrent.ClientConfig, p proxy.Config, forward proxy.DialFunc) (torrent.Dialer, error) {
+	if p.URL == "" {
+		return nil, nil
+	}
+	dial, err := p.DialerVia(forward)
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(p.URL)
+
+	if p.ForTrackers() {
+		// HTTP and websocket trackers and web seeds
+		if u.Scheme == "http" {
+			cfg.HTTPProxy = func(*http.Request) (*url.URL, error) { return u, nil }
+			cfg.HTTPDialContext = forward
+		} else {
+			cfg.HTTPDialContext = dial
+		}
+		cfg.TrackerDialContext = dial
+		names := newTrackerNames()
+		cfg.LookupTrackerIp = names.lookup
+		cfg.HttpRequestDirector = names.restore
+		// UDP trackers cannot go through a TCP proxy
+		cfg.TrackerListenPacket = func(network, addr string) (net.PacketConn, error) {
+			return nil, fmt.Errorf("UDP trackers are disabled while trackers use a proxy")
+		}
+	}
+
+	if !p.ForPeers() {
+		return nil, nil
+	}
+	// Without sockets of its own the client neither accepts peers nor runs
+	// the DHT, every outgoing connection goes through the proxy dialer
+	cfg.DisableTCP = true
+	cfg.DisableUTP = true
+	cfg.NoDHT = true
+	cfg.AcceptPeerConnections = false
+	cfg.NoDefaultPortForwarding = true
+	cfg.DisableWebtorrent = true
+	return dialer.WithNetwork{Network: "tcp", Dialer: dial}, nil
+}
+
+// trackerNames keeps tracker host names away from the system resolver while
+// trackers use a proxy. anacrolix looks a tracker host up itself and puts
+// the address in the announce URL, so every host gets a placeholder from
+// 198.18.0.0/15, a range reserved for benchmarks that is never routed, and
+// the announce request gets the name back before it is sent. The proxy then
+// resolves it. UDP trackers are refused under a proxy, so only HTTP ones
+// reach restore.
+type trackerNames struct {
+	mu    sync.Mutex
+	addrs map[string]netip.Addr
+	names map[netip.Addr]string
+	next  netip.Addr
+}
+
+func newTrackerNames() *trackerNames {
+	return &trackerNames{
+		addrs: make(map[string]netip.Addr),
+		names: make(map[netip.Addr]string),
+		next:  netip.AddrFrom4([4]byte{198, 18, 0, 1}),
+	}
+}
+
+var trackerNameRange = netip.MustParsePrefix("198.18.0.0/15")
+
+// lookup is installed as LookupTrackerIp, returning the placeholder of the host
+func (n *trackerNames) lookup(u *url.URL) ([]net.IP, error) {
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addr, ok := n.addrs[host]
+	if !ok {
+		if !trackerNameRange.Contains(n.next) {
+			return nil, fmt.Errorf("too many tracker hosts to hand to the proxy")
+		}
+		addr = n.next
+		n.next = n.next.Next()
+		n.addrs[host] = addr
+		n.names[addr] = host
+	}
+	return []net.IP{addr.AsSlice()}, nil
+}
+
+// restore is installed as HttpRequestDirector, putting the host name back
+// in place of its placeholder
+func (n *trackerNames) restore(req *http.Request) error {
+	host, port, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		// Without a port anacrolix leaves the name in the URL
+		return nil
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	n.mu.Lock()
+	name, ok := n.names[addr]
+	n.mu.Unlock()
+	if ok {
+		req.URL.Host = net.JoinHostPort(name, port)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package torrent
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/serene-brew/ztorrent/proxy"
+	"github.com/serene-brew/ztorrent/proxy/proxytest"
+)
+
+func TestSessionDialsThroughProxy(t *testing.T) {
+	dir := t.TempDir()
+	torrentPath := writeTestTorrent(t, dir)
+
+	seedConf := DefaultConfig()
+	seedConf.StateDir = filepath.Join(dir, "seed-state")
+	seeder, err := NewSession(seedConf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	if _, err := seeder.AddTorrentWithData(torrentPath, dir); err != nil {
+		t.Fatal(err)
+	}
+	seederAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(seeder.client.LocalPort()))
+
+	announced := make(chan struct{}, 1)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case announced <- struct{}{}:
+		default:
+		}
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	socks := proxytest.NewServer()
+	defer socks.Close()
+
+	conf := DefaultConfig()
+	conf.StateDir = filepath.Join(dir, "state")
+	conf.Proxy = proxy.Config{URL: socks.URL, Peers: true, Trackers: true}
+	s, err := NewSession(conf, filepath.Join(dir, "download"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h, err := s.AddTorrentFile(torrentPath, AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.tor.AddTrackers([][]string{{tracker.URL + "/announce"}})
+	h.tor.AddPeers([]torrent.PeerInfo{{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: seeder.client.LocalPort()}}})
+
+	select {
+	case <-announced:
+	case <-time.After(10 * time.Second):
+		t.Fatal("tracker was never announced to")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for h.tor.BytesCompleted() < h.tor.Length() {
+		if time.Now().After(deadline) {
+			t.Fatal("download did not finish through the proxy")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if host := strings.TrimPrefix(tracker.URL, "http://"); !socks.Dialed(host) {
+		t.Errorf("tracker %s was not dialed through the proxy, dials %v", host, socks.Dials())
+	}
+	if !socks.Dialed(seederAddr) {
+		t.Errorf("peer %s was not dialed through the proxy, dials %v", seederAddr, socks.Dials())
+	}
+}
+
+func TestTrackerNamesResolvedByProxy(t *testing.T) {
+	dir := t.TempDir()
+	announced := make(chan struct{}, 1)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case announced <- struct{}{}:
+		default:
+		}
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(tracker.URL, "http://"))
+
+	// The name does not resolve, so only the proxy can reach the tracker
+	socks := proxytest.NewServer()
+	defer socks.Close()
+	socks.Alias("tracker.invalid", "127.0.0.1")
+
+	conf := DefaultConfig()
+	conf.StateDir = filepath.Join(dir, "state")
+	conf.Proxy = proxy.Config{URL: socks.URL, Only: true}
+	s, err := NewSession(conf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h, err := s.AddTorrentFile(writeTestTorrent(t, dir), AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.tor.AddTrackers([][]string{{"http://tracker.invalid:" + port + "/announce"}})
+
+	select {
+	case <-announced:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("tracker was never announced to, dials %v", socks.Dials())
+	}
+	if want := "tracker.invalid:" + port; !socks.Dialed(want) {
+		t.Errorf("proxy was not asked for %s, dials %v", want, socks.Dials())
+	}
+}
+
+func TestProxyOnlyDisablesDirectSockets(t *testing.T) {
+	socks := proxytest.NewServer()
+	defer socks.Close()
+
+	tests := []struct {
+		name  string
+		proxy proxy.Config
+		udp   bool // UDP trackers usable
+		dht   bool
+	}{
+		{"no proxy", proxy.Config{}, true, true},
+		{"trackers", proxy.Config{URL: socks.URL, Trackers: true}, false, true},
+		{"peers", proxy.Config{URL: socks.URL, Peers: true}, true, false},
+		{"proxy only", proxy.Config{URL: socks.URL, Only: true}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := DefaultConfig()
+			conf.Proxy = tt.proxy
+			cfg, err := newClientConfig(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := applyProxy(cfg, conf.Proxy, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			udp := true
+			if cfg.TrackerListenPacket != nil {
+				if c, err := cfg.TrackerListenPacket("udp", "127.0.0.1:0"); err != nil {
+					udp = false
+				} else {
+					c.Close()
+				}
+			}
+			if udp != tt.udp {
+				t.Errorf("UDP trackers usable %v, want %v", udp, tt.udp)
+			}
+			if dht := !cfg.NoDHT; dht != tt.dht {
+				t.Errorf("DHT on %v, want %v", dht, tt.dht)
+			}
+			if tt.proxy.Only && (!cfg.DisableTCP || !cfg.DisableUTP || cfg.AcceptPeerConnections) {
+				t.Error("proxy only mode left a listening socket open")
+			}
+		})
+	}
+
+	// The running client has no DHT server either
+	dir := t.TempDir()
+	conf := DefaultConfig()
+	conf.StateDir = filepath.Join(dir, "state")
+	conf.Proxy = proxy.Config{URL: socks.URL, Only: true}
+	s, err := NewSession(conf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if servers := s.client.DhtServers(); len(servers) != 0 {
+		t.Errorf("proxy only session runs %d DHT servers", len(servers))
+	}
+}
@@ -0,0 +1,221 @@
+package torrent
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// queueInterval is how often the queue is re-evaluated without any event
+	queueInterval = 5 * time.Second
+	// stallRate is the payload rate in bytes per second below which a torrent makes no progress
+	stallRate = 1024
+)
+
+var stateNames = map[TorrentState]string{
+	StateDownloading: "downloading",
+	StateSeeding:     "seeding",
+	StateComplete:    "complete",
+	StateStalled:     "stalled",
+	StateQueued:      "queued",
+	StatePaused:      "paused",
+	StateChecking:    "checking",
+	StateMoving:      "moving",
+	StateError:       "error",
+	StateOffline:     "offline",
+}
+
+// String returns the name shown in the TUI
+func (s TorrentState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("TorrentState(%d)", int(s))
+}
+
+// QueueMove says where MoveInQueue takes a torrent
+type QueueMove int
+
+const (
+	QueueUp QueueMove = iota
+	QueueDown
+	QueueTop
+	QueueBottom
+)
+
+// State returns where the torrent is in its lifecycle
+func (h *Handle) State() TorrentState {
+	offline := h.session.iface.down()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch {
+	case h.moving:
+		return StateMoving
+	case h.checking:
+		return StateChecking
+	case h.err != nil:
+		return StateError
+	case h.paused:
+		return StatePaused
+	case offline:
+		return StateOffline
+	case h.queued:
+		return StateQueued
+	case h.stalled:
+		return StateStalled
+	case !h.completedAt.IsZero() && h.session.config.Seed:
+		return StateSeeding
+	case !h.completedAt.IsZero():
+		return StateComplete
+	}
+	return StateDownloading
+}
+
+// QueuePosition returns the zero based place of the torrent in the queue
+func (h *Handle) QueuePosition() int {
+	s := h.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, ih := range s.queue {
+		if ih == h.InfoHash() {
+			return i
+		}
+	}
+	return -1
+}
+
+// Queue returns every handle in queue order
+func (s *Session) Queue() []*Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	handles := make([]*Handle, 0, len(s.queue))
+	for _, ih := range s.queue {
+		handles = append(handles, s.handles[ih])
+	}
+	return handles
+}
+
+// MoveInQueue changes the queue position of a torrent and starts or queues
+// torrents to match
+func (s *Session) MoveInQueue(infoHash string, move QueueMove) error {
+	s.mu.Lock()
+	i := -1
+	for j, ih := range s.queue {
+		if ih == infoHash {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		s.mu.Unlock()
+		return fmt.Errorf("torrent %s not found", infoHash)
+	}
+
+	to := i
+	switch move {
+	case QueueUp:
+		to = i - 1
+	case QueueDown:
+		to = i + 1
+	case QueueTop:
+		to = 0
+	case QueueBottom:
+		to = len(s.queue) - 1
+	}
+	if to < 0 {
+		to = 0
+	}
+	if to >= len(s.queue) {
+		to = len(s.queue) - 1
+	}
+
+	queue := append(s.queue[:i:i], s.queue[i+1:]...)
+	queue = append(queue[:to], append([]string{infoHash}, queue[to:]...)...)
+	s.queue = queue
+	s.mu.Unlock()
+
+	s.updateQueue()
+	return s.saveAll()
+}
+
+// sortQueue orders the queue by the positions restored from resume files,
+// the caller must hold s.mu
+func (s *Session) sortQueue(positions map[string]int) {
+	sort.SliceStable(s.queue, func(i, j int) bool {
+		return positions[s.queue[i]] < positions[s.queue[j]]
+	})
+}
+
+// updateQueue starts torrents in queue order up to the active download and
+// seed limits and queues the rest. Stalled torrents keep running but leave
+// their slot to the next one in line.
+func (s *Session) updateQueue() {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+
+	// Nothing transfers while offline, so the queue waits for the interface
+	if s.iface.down() {
+		return
+	}
+
+	now := time.Now()
+	stallAfter := time.Duration(s.config.StalledMinutes) * time.Minute
+	downloads, seeds := 0, 0
+
+	for _, h := range s.Queue() {
+		rates := h.rates.Sample(h.tor)
+
+		h.mu.Lock()
+		if h.paused || h.checking {
+			h.mu.Unlock()
+			continue
+		}
+		complete := !h.completedAt.IsZero()
+		// Finished torrents never upload without seeding, so they take no slot
+		idle := complete && !s.config.Seed
+
+		max, count := s.config.MaxActiveDownloads, &downloads
+		rate := rates.Download
+		if complete {
+			max, count = s.config.MaxActiveSeeds, &seeds
+			rate = rates.Upload
+		}
+
+		queued := !idle && max > 0 && *count >= max
+		if queued || h.queued || rate >= stallRate {
+			// Waiting or just started torrents get a full stall window once running
+			h.activeAt = now
+		}
+		stalled := !idle && !queued && stallAfter > 0 && now.Sub(h.activeAt) >= stallAfter
+		if !idle && !queued && !stalled {
+			*count++
+		}
+		changed := queued != h.queued
+		h.queued, h.stalled = queued, stalled
+		h.mu.Unlock()
+
+		if changed {
+			h.updateTransfer()
+		}
+	}
+}
+
+// queueLoop re-evaluates the queue until the session closes, so stalled
+// torrents give up their slot and finished ones move to the seed limit
+func (s *Session) queueLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(queueInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.updateQueue()
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package torrent
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	// rateTau is the time constant of the rate EWMA, roughly how far back a rate "remembers"
+	rateTau = 5 * time.Second
+	// minSampleInterval avoids noisy rates when callers sample in quick succession
+	minSampleInterval = 200 * time.Millisecond
+)
+
+// Rates holds smoothed transfer rates in bytes per second
+type Rates struct {
+	Download         float64 // payload only
+	Upload           float64
+	DownloadOverhead float64 // protocol bytes on the wire beyond the payload
+	UploadOverhead   float64
+}
+
+// ewma turns a cumulative byte counter into an exponentially weighted rate
+type ewma struct {
+	last   int64
+	rate   float64
+	primed bool
+}
+
+// update feeds the latest counter value, dt after the previous one. The first
+// value only sets the baseline so bytes from earlier runs never count as speed.
+func (e *ewma) update(total int64, dt time.Duration) {
+	if !e.primed || dt <= 0 {
+		e.last = total
+		e.primed = true
+		return
+	}
+	delta := total - e.last
+	if delta < 0 {
+		delta = 0
+	}
+	e.last = total
+	instant := float64(delta) / dt.Seconds()
+	alpha := 1 - math.Exp(-dt.Seconds()/rateTau.Seconds())
+	e.rate += alpha * (instant - e.rate)
+}
+
+// peerRate holds the smoothed rates of a single peer connection
+type peerRate struct {
+	down ewma
+	up   ewma
+}
+
+// RateEstimator smooths the byte counters of a torrent and its peers into
+// recent transfer rates, sampled whenever progress is requested
+type RateEstimator struct {
+	mu    sync.Mutex
+	last  time.Time
+	rates Rates
+
+	down, up, downWire, upWire ewma
+	peers                      map[*torrent.PeerConn]*peerRate
+	// written is the sent piece data already credited to peers
+	written int64
+}
+
+// NewRateEstimator returns an estimator with no history
+func NewRateEstimator() *RateEstimator {
+	return &RateEstimator{peers: make(map[*torrent.PeerConn]*peerRate)}
+}
+
+// Sample updates the estimator from tor and returns the current rates
+func (r *RateEstimator) Sample(tor *torrent.Torrent) Rates {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	dt := now.Sub(r.last)
+	if !r.last.IsZero() && dt < minSampleInterval {
+		return r.rates
+	}
+	r.last = now
+
+	stats := tor.Stats()
+	r.down.update(stats.BytesReadData.Int64(), dt)
+	r.up.update(stats.BytesWrittenData.Int64(), dt)
+	r.downWire.update(stats.BytesRead.Int64(), dt)
+	r.upWire.update(stats.BytesWritten.Int64(), dt)
+
+	r.rates = Rates{
+		Download:         r.down.rate,
+		Upload:           r.up.rate,
+		DownloadOverhead: math.Max(r.downWire.rate-r.down.rate, 0),
+		UploadOverhead:   math.Max(r.upWire.rate-r.up.rate, 0),
+	}
+
+	conns := tor.PeerConns()
+	written := stats.BytesWrittenData.Int64()
+	creditUploads(conns, written-r.written)
+	r.written = written
+
+	seen := make(map[*torrent.PeerConn]bool)
+	for _, pc := range conns {
+		seen[pc] = true
+		pr, ok := r.peers[pc]
+		if !ok {
+			pr = &peerRate{}
+			r.peers[pc] = pr
+		}
+		down, up := peerTraffic(pc)
+		pr.down.update(down, dt)
+		pr.up.update(up, dt)
+	}
+	for pc := range r.peers {
+		if !seen[pc] {
+			delete(r.peers, pc)
+		}
+	}
+
+	return r.rates
+}
+
+// Rates returns the rates computed by the last Sample
+func (r *RateEstimator) Rates() Rates {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rates
+}
+
+// PeerRates returns the smoothed download and upload rate of pc
+func (r *RateEstimator) PeerRates(pc *torrent.PeerConn) (down, up float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if pr, ok := r.peers[pc]; ok {
+		return pr.down.rate, pr.up.rate
+	}
+	return 0, 0
+}
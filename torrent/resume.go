@@ -0,0 +1,249 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	abencode "github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const resumeExt = ".resume"
+
+// resumeData is the bencoded record kept for every torrent in a session
+type resumeData struct {
+	InfoHash    string   `bencode:"info_hash"`
+	Magnet      string   `bencode:"magnet,omitempty"`
+	MetaInfo    []byte   `bencode:"metainfo,omitempty"`
+	SavePath    string   `bencode:"save_path"`
+	Priorities  []int    `bencode:"file_priorities,omitempty"`
+	Paused      bool     `bencode:"paused"`
+	Uploaded    int64    `bencode:"uploaded"`
+	Downloaded  int64    `bencode:"downloaded"`
+	AddedAt     int64    `bencode:"added_at"`
+	CompletedAt int64    `bencode:"completed_at,omitempty"`
+	Labels      []string `bencode:"labels,omitempty"`
+	DownLimit   int64    `bencode:"download_limit,omitempty"`
+	UpLimit     int64    `bencode:"upload_limit,omitempty"`
+
+	SeedGoal    *seedGoalData `bencode:"seed_goal,omitempty"`
+	SeedSeconds int64         `bencode:"seed_seconds,omitempty"`
+	SeedOnly    bool          `bencode:"seed_only,omitempty"`
+
+	QueuePosition int `bencode:"queue_position"`
+
+	MoveOnComplete  bool  `bencode:"move_on_complete,omitempty"`
+	Sequential      bool  `bencode:"sequential,omitempty"`
+	SequentialFiles []int `bencode:"sequential_files,omitempty"`
+
+	// Storage is empty in resume data written before storage kinds existed
+	Storage StorageKind `bencode:"storage,omitempty"`
+}
+
+func (s *Session) resumeDir() string {
+	return filepath.Join(s.stateDir, "resume")
+}
+
+func (s *Session) resumePath(infoHash string) string {
+	return filepath.Join(s.resumeDir(), infoHash+resumeExt)
+}
+
+// snapshot captures the current state of h for persisting
+func (h *Handle) snapshot() resumeData {
+	position := h.QueuePosition()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := resumeData{
+		InfoHash:   h.InfoHash(),
+		Magnet:     h.magnet,
+		SavePath:   h.savePath,
+		Paused:     h.paused,
+		Uploaded:   h.uploadedBase,
+		Downloaded: h.downloadedBase,
+		AddedAt:    h.addedAt.Unix(),
+		Labels:     append([]string(nil), h.labels...),
+		DownLimit:  h.limits.Download,
+		UpLimit:    h.limits.Upload,
+
+		SeedGoal:    encodeSeedGoal(h.seedGoal),
+		SeedSeconds: int64(h.seed.seeding / time.Second),
+		SeedOnly:    h.seedOnly,
+
+		QueuePosition: position,
+		Storage:       h.storageKind,
+
+		Sequential:     h.sequential,
+		MoveOnComplete: h.moveOnComplete,
+	}
+	for _, p := range h.priorities {
+		r.Priorities = append(r.Priorities, int(p))
+	}
+	for i := range h.seqFiles {
+		r.SequentialFiles = append(r.SequentialFiles, i)
+	}
+	sort.Ints(r.SequentialFiles)
+	if !h.completedAt.IsZero() {
+		r.CompletedAt = h.completedAt.Unix()
+	}
+
+	select {
+	case <-h.tor.Closed():
+		return r
+	default:
+	}
+
+	stats := h.tor.Stats()
+	r.Uploaded += stats.BytesWrittenData.Int64()
+	r.Downloaded += stats.BytesReadData.Int64()
+
+	if h.tor.Info() != nil {
+		var buf bytes.Buffer
+		mi := h.tor.Metainfo()
+		if err := mi.Write(&buf); err == nil {
+			r.MetaInfo = buf.Bytes()
+		}
+	}
+	return r
+}
+
+// save writes the resume file for h atomically
+func (h *Handle) save() error {
+	h.saveMu.Lock()
+	defer h.saveMu.Unlock()
+	h.mu.Lock()
+	removed := h.removed
+	h.mu.Unlock()
+	if removed {
+		return nil
+	}
+
+	r := h.snapshot()
+	data, err := abencode.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode resume data: %v", err)
+	}
+
+	dir := h.session.resumeDir()
+	tmp, err := os.CreateTemp(dir, ".resume-*")
+	if err != nil {
+		return fmt.Errorf("failed to write resume data: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write resume data: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write resume data: %v", err)
+	}
+	return os.Rename(tmp.Name(), h.session.resumePath(r.InfoHash))
+}
+
+// saveAll persists every torrent, returning the first error
+func (s *Session) saveAll() error {
+	var first error
+	for _, h := range s.Torrents() {
+		if err := h.save(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// saveLoop periodically persists transfer counters until the session closes
+func (s *Session) saveLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.saveAll()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// restore re-adds every torrent found in the resume directory
+func (s *Session) restore() []error {
+	entries, err := os.ReadDir(s.resumeDir())
+	if err != nil {
+		return []error{fmt.Errorf("failed to read resume directory: %v", err)}
+	}
+
+	var failed []error
+	positions := make(map[string]int)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), resumeExt) {
+			continue
+		}
+		if err := s.restoreFile(filepath.Join(s.resumeDir(), entry.Name()), positions); err != nil {
+			failed = append(failed, fmt.Errorf("failed to restore %s: %v", entry.Name(), err))
+		}
+	}
+
+	s.mu.Lock()
+	s.sortQueue(positions)
+	s.mu.Unlock()
+	s.updateQueue()
+	return failed
+}
+
+// RestoreErrors returns the saved torrents that could not be restored when
+// the session started, which are left in the state directory
+func (s *Session) RestoreErrors() []error {
+	return append([]error(nil), s.restoreErrs...)
+}
+
+// restoreFile re-adds the torrent saved at path, recording its queue position
+func (s *Session) restoreFile(path string, positions map[string]int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var r resumeData
+	if err := abencode.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("corrupt resume data: %v", err)
+	}
+
+	var spec *torrent.TorrentSpec
+	if len(r.MetaInfo) > 0 {
+		mi, err := metainfo.Load(bytes.NewReader(r.MetaInfo))
+		if err != nil {
+			return fmt.Errorf("corrupt metainfo: %v", err)
+		}
+		if spec, err = torrent.TorrentSpecFromMetaInfoErr(mi); err != nil {
+			return err
+		}
+	} else {
+		if spec, err = torrent.TorrentSpecFromMagnetUri(r.Magnet); err != nil {
+			return fmt.Errorf("invalid magnet: %v", err)
+		}
+	}
+
+	positions[spec.InfoHash.HexString()] = r.QueuePosition
+	kind := r.Storage
+	if kind == "" {
+		kind = StorageFile
+	}
+	_, err = s.addSpec(spec, r.Magnet, AddOptions{
+		SavePath: r.SavePath,
+		Paused:   r.Paused,
+		Labels:   r.Labels,
+		Limits:   Limits{Download: r.DownLimit, Upload: r.UpLimit},
+		SeedGoal: decodeSeedGoal(r.SeedGoal),
+		Storage:  kind,
+	}, &r)
+	return err
+}
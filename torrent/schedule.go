@@ -0,0 +1,263 @@
+package torrent
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scheduleInterval is how often the schedule is evaluated against the clock
+const scheduleInterval = 15 * time.Second
+
+// Schedule switches limit profiles and pauses or resumes torrents by label
+// at set times of the week
+type Schedule struct {
+	// Profiles are named limits rules can switch to
+	Profiles map[string]Limits `json:"profiles"`
+	// Rules are evaluated in order, a later active rule's profile wins
+	Rules []ScheduleRule `json:"rules"`
+}
+
+// ScheduleRule is active from From until To on each of Days. A window that
+// ends before it starts runs past midnight into the next day.
+type ScheduleRule struct {
+	Name    string   `json:"name"`
+	Days    []string `json:"days"`    // mon..sun, weekdays, weekend or everyday; empty is every day
+	From    string   `json:"from"`    // 15:04, empty is midnight
+	To      string   `json:"to"`      // 15:04, equal to From covers the whole day
+	Profile string   `json:"profile"` // limits applied while active, empty leaves limits alone
+	Pause   []string `json:"pause"`   // labels of torrents paused when the rule starts
+	Resume  []string `json:"resume"`  // labels of torrents resumed when the rule starts
+}
+
+var dayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekend":  {time.Saturday, time.Sunday},
+	"everyday": {time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday},
+}
+
+// Validate reports the first rule that cannot be evaluated
+func (s Schedule) Validate() error {
+	for name, l := range s.Profiles {
+		if err := l.Validate(); err != nil {
+			return fmt.Errorf("schedule profile %q: %v", name, err)
+		}
+	}
+	for i, r := range s.Rules {
+		if _, err := r.window(); err != nil {
+			return fmt.Errorf("schedule rule %d: %v", i, err)
+		}
+		if r.Profile != "" {
+			if _, ok := s.Profiles[r.Profile]; !ok {
+				return fmt.Errorf("schedule rule %d: unknown profile %q", i, r.Profile)
+			}
+		}
+	}
+	return nil
+}
+
+// window is a rule compiled for evaluation
+type window struct {
+	days     [7]bool
+	from, to int // minutes since midnight
+}
+
+func (r ScheduleRule) window() (window, error) {
+	var w window
+	if len(r.Days) == 0 {
+		r.Days = []string{"everyday"}
+	}
+	for _, d := range r.Days {
+		days, ok := dayNames[strings.ToLower(d)]
+		if !ok {
+			return w, fmt.Errorf("unknown day %q", d)
+		}
+		for _, day := range days {
+			w.days[day] = true
+		}
+	}
+
+	var err error
+	if w.from, err = parseClock(r.From); err != nil {
+		return w, err
+	}
+	if w.to, err = parseClock(r.To); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+// parseClock returns the minutes since midnight of a 15:04 time
+func parseClock(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether the window covers t
+func (w window) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+
+	switch {
+	case w.from == w.to:
+		return w.days[day]
+	case w.from < w.to:
+		return w.days[day] && m >= w.from && m < w.to
+	default:
+		// Past midnight, the early hours belong to the previous day's window
+		return (w.days[day] && m >= w.from) || (w.days[yesterday] && m < w.to)
+	}
+}
+
+// Scheduler evaluates a Schedule against a clock. It only changes state when
+// Evaluate is called, so the same times always give the same results.
+type Scheduler struct {
+	mu       sync.Mutex
+	schedule Schedule
+	windows  []window
+	now      func() time.Time
+	active   []bool
+	started  bool
+}
+
+// NewScheduler compiles schedule, now is the clock and defaults to time.Now
+func NewScheduler(schedule Schedule, now func() time.Time) (*Scheduler, error) {
+	if err := schedule.Validate(); err != nil {
+		return nil, err
+	}
+	if now == nil {
+		now = time.Now
+	}
+	s := &Scheduler{
+		schedule: schedule,
+		now:      now,
+		active:   make([]bool, len(schedule.Rules)),
+	}
+	for _, r := range schedule.Rules {
+		w, _ := r.window()
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+// SetClock replaces the clock the scheduler reads
+func (s *Scheduler) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// ScheduleState is the outcome of evaluating a schedule at one instant
+type ScheduleState struct {
+	// Profile is the name of the profile in force, empty when no rule sets one
+	Profile string
+	Limits  Limits
+	// Started holds the rules that became active since the last evaluation,
+	// every active rule on the first one
+	Started []ScheduleRule
+}
+
+// Evaluate reads the clock and returns the profile in force and the rules
+// that have just started
+func (s *Scheduler) Evaluate() ScheduleState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	var state ScheduleState
+	for i, w := range s.windows {
+		rule := s.schedule.Rules[i]
+		active := w.contains(now)
+		if active && (!s.active[i] || !s.started) {
+			state.Started = append(state.Started, rule)
+		}
+		if active && rule.Profile != "" {
+			state.Profile = rule.Profile
+			state.Limits = s.schedule.Profiles[rule.Profile]
+		}
+		s.active[i] = active
+	}
+	s.started = true
+	return state
+}
+
+// ApplySchedule evaluates the schedule now, switching the limit profile and
+// pausing or resuming labelled torrents for rules that have just started
+func (s *Session) ApplySchedule() {
+	state := s.scheduler.Evaluate()
+
+	s.bandwidth.mu.Lock()
+	s.bandwidth.profile = state.Profile
+	s.bandwidth.scheduled = state.Limits
+	s.bandwidth.apply()
+	s.bandwidth.mu.Unlock()
+
+	for _, rule := range state.Started {
+		for _, h := range s.Torrents() {
+			switch {
+			case hasLabel(h, rule.Pause) && !h.Paused():
+				h.Pause()
+				h.save()
+			case hasLabel(h, rule.Resume) && h.Paused():
+				h.Resume()
+				h.save()
+			}
+		}
+	}
+}
+
+// SetClock replaces the clock of the session scheduler and re-evaluates it
+func (s *Session) SetClock(now func() time.Time) {
+	s.scheduler.SetClock(now)
+	s.ApplySchedule()
+}
+
+// Profile returns the name of the scheduled limit profile in force, empty when none is
+func (s *Session) Profile() string {
+	s.bandwidth.mu.Lock()
+	defer s.bandwidth.mu.Unlock()
+	return s.bandwidth.profile
+}
+
+// hasLabel reports whether h carries any of labels
+func hasLabel(h *Handle, labels []string) bool {
+	for _, want := range labels {
+		for _, l := range h.Labels() {
+			if l == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scheduleLoop applies the schedule until the session closes
+func (s *Session) scheduleLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.ApplySchedule()
+		case <-s.done:
+			return
+		}
+	}
+}
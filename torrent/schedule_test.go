@@ -0,0 +1,253 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	abencode "github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// at returns a time in the week of Monday 1 January 2024
+func at(day time.Weekday, clock string) time.Time {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		panic(err)
+	}
+	offset := (int(day) + 6) % 7
+	return time.Date(2024, 1, 1+offset, t.Hour(), t.Minute(), 0, 0, time.Local)
+}
+
+func TestWindowContains(t *testing.T) {
+	tests := []struct {
+		name string
+		rule ScheduleRule
+		at   time.Time
+		want bool
+	}{
+		{"inside", ScheduleRule{From: "09:00", To: "17:00"}, at(time.Wednesday, "12:00"), true},
+		{"at start", ScheduleRule{From: "09:00", To: "17:00"}, at(time.Wednesday, "09:00"), true},
+		{"at end", ScheduleRule{From: "09:00", To: "17:00"}, at(time.Wednesday, "17:00"), false},
+		{"before", ScheduleRule{From: "09:00", To: "17:00"}, at(time.Wednesday, "08:59"), false},
+		{"whole day", ScheduleRule{Days: []string{"sat"}}, at(time.Saturday, "23:59"), true},
+		{"whole day, other day", ScheduleRule{Days: []string{"sat"}}, at(time.Sunday, "00:00"), false},
+
+		{"weekdays on friday", ScheduleRule{Days: []string{"weekdays"}, From: "08:00", To: "18:00"}, at(time.Friday, "10:00"), true},
+		{"weekdays on saturday", ScheduleRule{Days: []string{"weekdays"}, From: "08:00", To: "18:00"}, at(time.Saturday, "10:00"), false},
+		{"weekend on sunday", ScheduleRule{Days: []string{"weekend"}, From: "08:00", To: "18:00"}, at(time.Sunday, "10:00"), true},
+		{"day names ignore case", ScheduleRule{Days: []string{"Mon", "WED"}}, at(time.Wednesday, "10:00"), true},
+
+		{"past midnight, evening", ScheduleRule{From: "23:00", To: "06:00"}, at(time.Tuesday, "23:30"), true},
+		{"past midnight, early hours", ScheduleRule{From: "23:00", To: "06:00"}, at(time.Wednesday, "05:59"), true},
+		{"past midnight, after end", ScheduleRule{From: "23:00", To: "06:00"}, at(time.Wednesday, "06:00"), false},
+		{"past midnight, afternoon", ScheduleRule{From: "23:00", To: "06:00"}, at(time.Wednesday, "15:00"), false},
+
+		// The early hours belong to the day the window started on
+		{"friday night into saturday", ScheduleRule{Days: []string{"fri"}, From: "22:00", To: "02:00"}, at(time.Saturday, "01:00"), true},
+		{"friday night, saturday evening", ScheduleRule{Days: []string{"fri"}, From: "22:00", To: "02:00"}, at(time.Saturday, "22:30"), false},
+		{"friday night, friday early hours", ScheduleRule{Days: []string{"fri"}, From: "22:00", To: "02:00"}, at(time.Friday, "01:00"), false},
+		{"sunday night into monday", ScheduleRule{Days: []string{"sun"}, From: "23:00", To: "01:00"}, at(time.Monday, "00:30"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := tt.rule.window()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.contains(tt.at); got != tt.want {
+				t.Errorf("contains(%s) = %v, want %v", tt.at.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+		ok       bool
+	}{
+		{"empty", Schedule{}, true},
+		{"unknown day", Schedule{Rules: []ScheduleRule{{Days: []string{"someday"}}}}, false},
+		{"bad time", Schedule{Rules: []ScheduleRule{{From: "25:00"}}}, false},
+		{"unknown profile", Schedule{Rules: []ScheduleRule{{Profile: "night"}}}, false},
+		{"negative limit", Schedule{Profiles: map[string]Limits{"night": {Download: -1}}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.schedule.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSchedulerEvaluate(t *testing.T) {
+	schedule := Schedule{
+		Profiles: map[string]Limits{
+			"work":  {Download: 100 << 10, Upload: 20 << 10},
+			"night": {},
+			"lunch": {Download: 500 << 10},
+		},
+		Rules: []ScheduleRule{
+			{Name: "work", Days: []string{"weekdays"}, From: "09:00", To: "17:00", Profile: "work"},
+			{Name: "lunch", Days: []string{"weekdays"}, From: "12:00", To: "13:00", Profile: "lunch"},
+			{Name: "night", From: "23:00", To: "07:00", Profile: "night", Resume: []string{"bulk"}},
+			{Name: "evening", From: "18:00", To: "23:00", Pause: []string{"bulk"}},
+		},
+	}
+
+	steps := []struct {
+		at      time.Time
+		profile string
+		limits  Limits
+		started []string
+	}{
+		// The first evaluation reports every active rule
+		{at(time.Monday, "10:00"), "work", schedule.Profiles["work"], []string{"work"}},
+		{at(time.Monday, "11:00"), "work", schedule.Profiles["work"], nil},
+		// A later rule wins while both are active
+		{at(time.Monday, "12:30"), "lunch", schedule.Profiles["lunch"], []string{"lunch"}},
+		{at(time.Monday, "13:00"), "work", schedule.Profiles["work"], nil},
+		{at(time.Monday, "17:30"), "", Limits{}, nil},
+		{at(time.Monday, "18:00"), "", Limits{}, []string{"evening"}},
+		{at(time.Monday, "23:15"), "night", Limits{}, []string{"night"}},
+		{at(time.Tuesday, "06:59"), "night", Limits{}, nil},
+		{at(time.Tuesday, "07:00"), "", Limits{}, nil},
+		// Weekend days skip the weekday rules
+		{at(time.Saturday, "10:00"), "", Limits{}, nil},
+		{at(time.Saturday, "18:30"), "", Limits{}, []string{"evening"}},
+		// A rule that stopped and started again between evaluations is not seen
+		{at(time.Sunday, "18:30"), "", Limits{}, nil},
+	}
+
+	var now time.Time
+	s, err := NewScheduler(schedule, func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range steps {
+		now = step.at
+		state := s.Evaluate()
+		when := step.at.Format("Mon 15:04")
+		if state.Profile != step.profile || state.Limits != step.limits {
+			t.Errorf("%s: profile %q %+v, want %q %+v", when, state.Profile, state.Limits, step.profile, step.limits)
+		}
+		var started []string
+		for _, r := range state.Started {
+			started = append(started, r.Name)
+		}
+		if len(started) != len(step.started) {
+			t.Errorf("%s: started %v, want %v", when, started, step.started)
+			continue
+		}
+		for i := range started {
+			if started[i] != step.started[i] {
+				t.Errorf("%s: started %v, want %v", when, started, step.started)
+				break
+			}
+		}
+	}
+}
+
+func TestSchedulerSetClock(t *testing.T) {
+	schedule := Schedule{Rules: []ScheduleRule{{Name: "night", From: "23:00", To: "07:00"}}}
+	s, err := NewScheduler(schedule, func() time.Time { return at(time.Monday, "12:00") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := s.Evaluate(); len(state.Started) != 0 {
+		t.Fatalf("started %v at noon", state.Started)
+	}
+	s.SetClock(func() time.Time { return at(time.Monday, "23:30") })
+	if state := s.Evaluate(); len(state.Started) != 1 {
+		t.Fatalf("night rule did not start after SetClock")
+	}
+}
+
+// writeTestTorrent writes a single file torrent of a few bytes to dir
+func writeTestTorrent(t *testing.T, dir string) string {
+	t.Helper()
+	data := filepath.Join(dir, "payload.bin")
+	if err := os.WriteFile(data, []byte("scheduled payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := metainfo.Info{PieceLength: 16 << 10}
+	if err := info.BuildFromFilePath(data); err != nil {
+		t.Fatal(err)
+	}
+	infoBytes, err := abencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "payload.torrent")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := (&metainfo.MetaInfo{InfoBytes: infoBytes}).Write(f); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSessionScheduleLabels(t *testing.T) {
+	dir := t.TempDir()
+	conf := DefaultConfig()
+	conf.StateDir = filepath.Join(dir, "state")
+	conf.Schedule = Schedule{
+		Profiles: map[string]Limits{"day": {Download: 64 << 10, Upload: 16 << 10}},
+		Rules: []ScheduleRule{
+			{Name: "day", From: "08:00", To: "20:00", Profile: "day", Pause: []string{"bulk"}},
+			{Name: "night", From: "20:00", To: "08:00", Resume: []string{"bulk"}},
+		},
+	}
+	s, err := NewSession(conf, filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	torrentPath := writeTestTorrent(t, dir)
+	bulk, err := s.AddTorrentFile(torrentPath, AddOptions{Labels: []string{"bulk"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The session started on the real clock, so begin at night and let the day rule start
+	s.SetClock(func() time.Time { return at(time.Tuesday, "07:30") })
+	if bulk.Paused() {
+		t.Error("bulk torrent paused at night")
+	}
+	s.SetClock(func() time.Time { return at(time.Tuesday, "09:00") })
+	if !bulk.Paused() {
+		t.Error("bulk torrent not paused when the day rule started")
+	}
+	if got := s.Profile(); got != "day" {
+		t.Errorf("profile %q, want day", got)
+	}
+	if got := s.Limits(); got != conf.Schedule.Profiles["day"] {
+		t.Errorf("limits %+v, want %+v", got, conf.Schedule.Profiles["day"])
+	}
+
+	// Resuming by hand sticks until a rule starts again
+	bulk.Resume()
+	s.SetClock(func() time.Time { return at(time.Tuesday, "10:00") })
+	if bulk.Paused() {
+		t.Error("bulk torrent paused again while the day rule stayed active")
+	}
+	bulk.Pause()
+
+	s.SetClock(func() time.Time { return at(time.Tuesday, "21:00") })
+	if bulk.Paused() {
+		t.Error("bulk torrent not resumed when the night rule started")
+	}
+	if got := s.Profile(); got != "" {
+		t.Errorf("profile %q after the day rule ended", got)
+	}
+}
@@ -0,0 +1,368 @@
+package torrent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	bencode "github.com/serene-brew/ztorrent/bencode"
+)
+
+// seedInterval is how often seeding torrents are checked against their goals
+const seedInterval = 10 * time.Second
+
+// SeedAction is what happens to a torrent once its seed goal is reached
+type SeedAction string
+
+const (
+	SeedPause      SeedAction = "pause"
+	SeedRemove     SeedAction = "remove"
+	SeedRemoveData SeedAction = "remove_data" // remove and delete the downloaded files
+)
+
+// SeedGoal stops seeding once any of its conditions is met. Zero conditions
+// are ignored, a goal without any seeds forever.
+type SeedGoal struct {
+	Ratio       float64    `json:"ratio"`        // uploaded over downloaded
+	SeedMinutes int        `json:"seed_minutes"` // time spent seeding
+	IdleMinutes int        `json:"idle_minutes"` // time without uploading anything
+	Action      SeedAction `json:"action"`
+}
+
+// Validate rejects negative conditions and unknown actions
+func (g SeedGoal) Validate() error {
+	if g.Ratio < 0 || g.SeedMinutes < 0 || g.IdleMinutes < 0 {
+		return fmt.Errorf("seed goal conditions cannot be negative")
+	}
+	switch g.Action {
+	case SeedPause, SeedRemove, SeedRemoveData, "":
+	default:
+		return fmt.Errorf("seed action must be one of pause, remove or remove_data, got %q", g.Action)
+	}
+	return nil
+}
+
+// reached reports which condition of g is met, if any
+func (g SeedGoal) reached(ratio float64, seeding, idle time.Duration) (string, bool) {
+	switch {
+	case g.Ratio > 0 && ratio >= g.Ratio:
+		return fmt.Sprintf("ratio %.2f reached", ratio), true
+	case g.SeedMinutes > 0 && seeding >= time.Duration(g.SeedMinutes)*time.Minute:
+		return fmt.Sprintf("seeded for %s", seeding.Round(time.Minute)), true
+	case g.IdleMinutes > 0 && idle >= time.Duration(g.IdleMinutes)*time.Minute:
+		return fmt.Sprintf("idle for %s", idle.Round(time.Minute)), true
+	}
+	return "", false
+}
+
+// seedState tracks how long a torrent has seeded and when it last uploaded
+type seedState struct {
+	seeding      time.Duration
+	lastUploaded int64
+	lastUploadAt time.Time
+}
+
+// update adds dt of seeding and notes any upload since the last call
+func (s *seedState) update(uploaded int64, now time.Time, dt time.Duration) {
+	if s.lastUploadAt.IsZero() || uploaded > s.lastUploaded {
+		s.lastUploaded = uploaded
+		s.lastUploadAt = now
+	}
+	s.seeding += dt
+}
+
+// idle returns how long it has been since the last upload
+func (s *seedState) idle(now time.Time) time.Duration {
+	if s.lastUploadAt.IsZero() {
+		return 0
+	}
+	return now.Sub(s.lastUploadAt)
+}
+
+// shareRatio is uploaded over downloaded. Data verified from disk rather than
+// downloaded counts as downloaded so seeding existing files has a finite ratio.
+func shareRatio(uploaded, downloaded, completed int64) float64 {
+	if completed > downloaded {
+		downloaded = completed
+	}
+	if downloaded == 0 {
+		return 0
+	}
+	return float64(uploaded) / float64(downloaded)
+}
+
+// seedGoalData is a SeedGoal as stored in resume files, which cannot hold floats
+type seedGoalData struct {
+	Ratio       string `bencode:"ratio"`
+	SeedMinutes int    `bencode:"seed_minutes"`
+	IdleMinutes int    `bencode:"idle_minutes"`
+	Action      string `bencode:"action"`
+}
+
+func encodeSeedGoal(g *SeedGoal) *seedGoalData {
+	if g == nil {
+		return nil
+	}
+	return &seedGoalData{
+		Ratio:       strconv.FormatFloat(g.Ratio, 'f', -1, 64),
+		SeedMinutes: g.SeedMinutes,
+		IdleMinutes: g.IdleMinutes,
+		Action:      string(g.Action),
+	}
+}
+
+func decodeSeedGoal(d *seedGoalData) *SeedGoal {
+	if d == nil {
+		return nil
+	}
+	ratio, _ := strconv.ParseFloat(d.Ratio, 64)
+	return &SeedGoal{
+		Ratio:       ratio,
+		SeedMinutes: d.SeedMinutes,
+		IdleMinutes: d.IdleMinutes,
+		Action:      SeedAction(d.Action),
+	}
+}
+
+// Ratio returns the share ratio of the torrent across restarts
+func (h *Handle) Ratio() float64 {
+	return shareRatio(h.Uploaded(), h.Downloaded(), h.tor.BytesCompleted())
+}
+
+// Seeding reports whether the torrent is complete and still uploading
+func (h *Handle) Seeding() bool {
+	offline := h.session.iface.down()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.session.config.Seed && !h.completedAt.IsZero() && !h.paused && !h.queued && !offline
+}
+
+// SeedTime returns how long the torrent has seeded, across restarts
+func (h *Handle) SeedTime() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.seed.seeding
+}
+
+// SetSeedGoal overrides the session seed goal for this torrent, nil restores it
+func (h *Handle) SetSeedGoal(g *SeedGoal) error {
+	if g != nil {
+		if err := g.Validate(); err != nil {
+			return err
+		}
+		c := *g
+		g = &c
+	}
+	h.mu.Lock()
+	h.seedGoal = g
+	h.mu.Unlock()
+	return h.save()
+}
+
+// SeedGoal returns the goal in force for this torrent
+func (h *Handle) SeedGoal() SeedGoal {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.seedGoal != nil {
+		return *h.seedGoal
+	}
+	return h.session.config.SeedGoal
+}
+
+// checkSeed advances the seed clock of h and reports the action due, if its goal is reached
+func (h *Handle) checkSeed(now time.Time, dt time.Duration) (SeedAction, string, bool) {
+	if !h.Seeding() {
+		return "", "", false
+	}
+	uploaded := h.Uploaded()
+	ratio := h.Ratio()
+	goal := h.SeedGoal()
+
+	h.mu.Lock()
+	h.seed.update(uploaded, now, dt)
+	reason, ok := goal.reached(ratio, h.seed.seeding, h.seed.idle(now))
+	h.mu.Unlock()
+
+	if goal.Action == "" {
+		goal.Action = SeedPause
+	}
+	return goal.Action, reason, ok
+}
+
+// seedLoop stops torrents that reach their seed goal until the session closes
+func (s *Session) seedLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(seedInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			dt := now.Sub(last)
+			last = now
+			for _, h := range s.Torrents() {
+				action, reason, ok := h.checkSeed(now, dt)
+				if !ok {
+					continue
+				}
+				s.publish(SeedGoalEvent{EventHeader: h.eventHeader(), Action: action, Reason: reason})
+				switch action {
+				case SeedRemove:
+					s.Remove(h.InfoHash())
+				case SeedRemoveData:
+					s.RemoveData(h.InfoHash())
+				default:
+					h.Pause()
+					h.save()
+				}
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// RemoveData removes a torrent from the session and deletes its downloaded files
+func (s *Session) RemoveData(infoHash string) error {
+	h, ok := s.Torrent(infoHash)
+	if !ok {
+		return fmt.Errorf("torrent %s not found", infoHash)
+	}
+	info := h.tor.Info()
+	savePath := h.SavePath()
+	kind := h.storageKind
+
+	if err := s.Remove(infoHash); err != nil {
+		return err
+	}
+	if info == nil {
+		// Nothing is stored before metadata arrives
+		return nil
+	}
+	if !kind.movable() {
+		return s.deleteStoredTorrent(kind, savePath, h.tor.InfoHash())
+	}
+
+	// File storage keeps every torrent under its name in the save path
+	name := info.BestName()
+	root := filepath.Join(savePath, name)
+	if name == "" || filepath.Dir(root) != filepath.Clean(savePath) {
+		return fmt.Errorf("refusing to delete %q outside %q", root, savePath)
+	}
+	if err := os.RemoveAll(root); err != nil {
+		return fmt.Errorf("failed to delete torrent data: %v", err)
+	}
+	return nil
+}
+
+// deleteStoredTorrent drops the pieces of infoHash from the database store of
+// kind in dir. Memory stores drop them when the torrent closes.
+func (s *Session) deleteStoredTorrent(kind StorageKind, dir string, infoHash metainfo.Hash) error {
+	st, err := s.storageOpener(kind)(dir)
+	if err != nil {
+		return fmt.Errorf("failed to delete torrent data: %v", err)
+	}
+	d, ok := st.(torrentDeleter)
+	if !ok {
+		return nil
+	}
+	if err := d.deleteTorrent(infoHash); err != nil {
+		return fmt.Errorf("failed to delete torrent data: %v", err)
+	}
+	return nil
+}
+
+// AddTorrentWithData adds a .torrent whose data already sits in dataDir,
+// verifies it against the piece hashes and seeds it without downloading.
+// dataDir may be the directory holding the torrent's files or its parent.
+// Torrents already in the session are refused, since a failed check
+// removes the torrent again.
+func (s *Session) AddTorrentWithData(torrentPath, dataDir string) (*Handle, error) {
+	meta, err := bencode.ParseTorrentFile(torrentPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse torrent file: %v", err)
+	}
+	if _, ok := s.Torrent(meta.InfoHash); ok {
+		return nil, fmt.Errorf("torrent %s is already in the session", meta.InfoHash)
+	}
+	savePath, err := locateData(meta, dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := s.AddTorrentFile(torrentPath, AddOptions{SavePath: savePath, Storage: StorageFile, SeedOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	h.checking = true
+	h.mu.Unlock()
+	h.updateTransfer()
+
+	<-h.tor.GotInfo()
+	complete := verifyPieces(h.tor, func(done, total int) {
+		h.mu.Lock()
+		h.checkDone, h.checkTotal = done, total
+		h.mu.Unlock()
+	})
+	h.mu.Lock()
+	h.checking = false
+	h.mu.Unlock()
+	h.updateTransfer()
+	if total := h.tor.NumPieces(); complete < total {
+		s.Remove(h.InfoHash())
+		return nil, fmt.Errorf("%d of %d pieces do not match the data in %s", total-complete, total, savePath)
+	}
+
+	h.mu.Lock()
+	if h.completedAt.IsZero() {
+		h.completedAt = time.Now()
+	}
+	h.mu.Unlock()
+	s.updateQueue()
+	return h, h.save()
+}
+
+// locateData returns the save path under which every file of meta exists
+// with the expected size, trying dataDir and then its parent
+func locateData(meta bencode.Torrent, dataDir string) (string, error) {
+	candidates := []string{dataDir}
+	if filepath.Base(filepath.Clean(dataDir)) == meta.Info.Name {
+		candidates = append(candidates, filepath.Dir(filepath.Clean(dataDir)))
+	}
+
+	var firstErr error
+	for _, dir := range candidates {
+		err := checkDataFiles(meta, dir)
+		if err == nil {
+			return dir, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", firstErr
+}
+
+// checkDataFiles stats every file of meta under savePath
+func checkDataFiles(meta bencode.Torrent, savePath string) error {
+	files := meta.Info.Files
+	if len(files) == 0 {
+		files = []bencode.FileInfo{{Length: meta.Info.Length}}
+	}
+	for _, f := range files {
+		path := filepath.Join(append([]string{savePath, meta.Info.Name}, f.Path...)...)
+		st, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("missing data file: %v", err)
+		}
+		if st.Size() != f.Length {
+			return fmt.Errorf("data file %s is %d bytes, torrent expects %d", path, st.Size(), f.Length)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// StreamHandler serves torrent files over HTTP while they download:
+//
+//	/stream/<infohash>/<fileindex>  the file, with Range support
+//	/playlist/<infohash>.m3u        an M3U playlist of the media files
+//
+// Unfinished files of paused, queued or otherwise stopped torrents are
+// refused with 409 or 503 instead of waiting for data that is not coming.
+func (s *Session) StreamHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream/", s.serveStream)
+	mux.HandleFunc("/playlist/", s.servePlaylist)
+	return mux
+}
+
+// startStreamServer listens on conf.StreamAddress until the session closes
+func (s *Session) startStreamServer() error {
+	ln, err := net.Listen("tcp", s.config.StreamAddress)
+	if err != nil {
+		return fmt.Errorf("failed to start stream server: %v", err)
+	}
+	s.streamServer = &http.Server{
+		Handler:           s.StreamHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go s.streamServer.Serve(ln)
+	return nil
+}
+
+// StreamURL returns the address of a file on the stream server, empty when it is disabled
+func (s *Session) StreamURL(infoHash string, index int) string {
+	if s.streamServer == nil {
+		return ""
+	}
+	return fmt.Sprintf("http://%s/stream/%s/%d", s.config.StreamAddress, infoHash, index)
+}
+
+func (s *Session) serveStream(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/stream/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	h, ok := s.Torrent(strings.ToLower(parts[0]))
+	if !ok {
+		http.Error(w, "unknown torrent", http.StatusNotFound)
+		return
+	}
+	index, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.Error(w, "invalid file index", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case <-h.tor.GotInfo():
+	case <-r.Context().Done():
+		return
+	}
+	reader, err := h.NewFileReader(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer reader.Close()
+
+	f := h.tor.Files()[index]
+	// Missing pieces would never arrive, so refuse rather than hang
+	if f.BytesCompleted() < f.Length() {
+		if status, reason := h.streamBlocked(); status != 0 {
+			if status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "10")
+			}
+			http.Error(w, reason, status)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", contentType(f.DisplayPath()))
+	// A reader bound to the request stops waiting for pieces once the client goes away
+	http.ServeContent(w, r, f.DisplayPath(), time.Time{}, contextReader{reader, r.Context()})
+}
+
+// streamBlocked returns the status refusing a stream of h while it does not
+// download, 409 until the user acts and 503 while it waits on the session,
+// or zero when it downloads
+func (h *Handle) streamBlocked() (int, string) {
+	switch state := h.State(); state {
+	case StatePaused, StateError:
+		return http.StatusConflict, "torrent is " + state.String() + ", resume it to stream"
+	case StateQueued, StateChecking, StateMoving, StateOffline:
+		return http.StatusServiceUnavailable, "torrent is " + state.String()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.seedOnly {
+		return http.StatusConflict, "torrent only seeds the data it was added with"
+	}
+	return 0, ""
+}
+
+func (s *Session) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	infoHash := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/playlist/"), ".m3u")
+	h, ok := s.Torrent(strings.ToLower(infoHash))
+	if !ok {
+		http.Error(w, "unknown torrent", http.StatusNotFound)
+		return
+	}
+	if h.tor.Info() == nil {
+		http.Error(w, "metadata not available yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	files := h.tor.Files()
+	var entries []int
+	for i, f := range files {
+		if isMedia(f.DisplayPath()) {
+			entries = append(entries, i)
+		}
+	}
+	if len(entries) == 0 {
+		for i := range files {
+			entries = append(entries, i)
+		}
+	}
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	fmt.Fprintln(w, "#EXTM3U")
+	for _, i := range entries {
+		u := url.URL{Scheme: "http", Host: r.Host, Path: fmt.Sprintf("/stream/%s/%d", h.InfoHash(), i)}
+		fmt.Fprintf(w, "#EXTINF:-1,%s\n%s\n", files[i].DisplayPath(), u.String())
+	}
+}
+
+// contentType guesses the MIME type of a file from its extension
+func contentType(name string) string {
+	if t := mime.TypeByExtension("." + strings.ToLower(getFileExtension(name))); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// isMedia reports whether a file looks like audio or video
+func isMedia(name string) bool {
+	t := contentType(name)
+	return strings.HasPrefix(t, "video/") || strings.HasPrefix(t, "audio/")
+}
+
+// contextReader reads through a torrent reader with a request context
+type contextReader struct {
+	torrent.Reader
+	ctx context.Context
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	return r.ReadContext(r.ctx, p)
+}
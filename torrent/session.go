@@ -0,0 +1,731 @@
+package torrent
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/anacrolix/torrent/types"
+)
+
+// Session owns a single anacrolix client shared by every torrent added to it
+type Session struct {
+	client   *torrent.Client
+	config   Config
+	dataDir  string
+	stateDir string
+
+	// completion is shared by every storage so piece state survives restarts
+	completion storage.PieceCompletion
+	// bandwidth holds the global limiters shared with the client
+	bandwidth *bandwidth
+	scheduler *Scheduler
+	// streamServer serves files over HTTP, nil when disabled
+	streamServer *http.Server
+	// geoip resolves peer countries, nil when no database is configured
+	geoip *GeoIP
+	// bans blocks peers that keep sending corrupt data, filter adds the
+	// configured blocklist and is what the client consults
+	bans   *banList
+	filter *peerFilter
+	// iface holds torrents while the listen interface is down and sockets
+	// follow its address, both nil when unbound
+	iface   *interfaceWatch
+	sockets *boundSockets
+	// events fans out what happens to subscribers, see Subscribe
+	events *eventBus
+	// logger records hook runs and watch folder adds, nil when neither is configured
+	logger  *log.Logger
+	logFile *os.File
+	// restoreErrs holds the saved torrents NewSession could not restore
+	restoreErrs []error
+
+	mu      sync.Mutex
+	handles map[string]*Handle
+	// storages holds the database and memory stores by kind and directory
+	storages map[string]storage.ClientImplCloser
+	queue    []string // info hashes in queue order
+
+	// queueMu serialises queue updates so limits are counted consistently
+	queueMu sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Handle is a torrent managed by a Session
+type Handle struct {
+	session *Session
+	tor     *torrent.Torrent
+
+	// saveMu is held from checking removed until the resume file is in
+	// place, so Remove cannot delete it in between
+	saveMu sync.Mutex
+
+	mu             sync.Mutex
+	magnet         string
+	savePath       string
+	paused         bool
+	labels         []string
+	addedAt        time.Time
+	completedAt    time.Time
+	startedAt      time.Time
+	rates          *RateEstimator
+	uploadedBase   int64
+	downloadedBase int64
+	removed        bool
+	limits         Limits
+	seedGoal       *SeedGoal
+	seedOnly       bool // existing data, never download
+	storage        *movableStorage
+	storageKind    StorageKind
+
+	// Moving data, moveOnComplete moves it to the complete directory once done
+	moving              bool
+	moveDone, moveTotal int64
+	moveOnComplete      bool
+	checking            bool
+	checkDone           int
+	checkTotal          int
+
+	// offenders are peers that sent pieces failing the hash check, kept so
+	// they stay in the peer list with their ban reason once dropped
+	offenders map[string]netip.Addr
+
+	// err pauses the torrent until it is resumed, warning is only reported
+	err, warning error
+	allocating   bool
+
+	// Sequential mode, seqPieces holds the pieces raised for it
+	sequential bool
+	seqFiles   map[int]bool
+	seqPieces  map[int]types.PiecePriority
+	seqCursors map[int]int // first missing piece of each range, earlier ones are done
+
+	// Queue state, activeAt is when the torrent last transferred or started
+	queued   bool
+	stalled  bool
+	activeAt time.Time
+	seed     seedState
+
+	// downHeld and upHeld are set while the torrent is over its own limits
+	downThrottle, upThrottle throttle
+	downHeld, upHeld         bool
+
+	// priorities is nil until metadata arrives, rules set before then wait in pendingRules
+	priorities   []Priority
+	pendingRules []FileRule
+
+	// Last state and tracker errors published as events
+	reported     TorrentState
+	reportedSeen bool
+	trackerErrs  map[string]string
+}
+
+// NewSession creates a client from conf that stores data under dataDir and
+// restores every torrent saved in the state directory by a previous run.
+// Torrents that fail to restore are reported by RestoreErrors.
+func NewSession(conf Config, dataDir string) (*Session, error) {
+	if dataDir == "" {
+		dataDir = GetDefaultDownloadPath()
+	}
+	stateDir := conf.StateDir
+	if stateDir == "" {
+		stateDir = DefaultStateDir()
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create downloads directory: %v", err)
+	}
+
+	bans := newBanList()
+	s := &Session{
+		config:    conf,
+		dataDir:   dataDir,
+		stateDir:  stateDir,
+		handles:   make(map[string]*Handle),
+		storages:  make(map[string]storage.ClientImplCloser),
+		bandwidth: newBandwidth(conf),
+		bans:      bans,
+		filter:    &peerFilter{bans: bans},
+		iface:     newInterfaceWatch(conf.ListenInterface),
+		events:    newEventBus(),
+		done:      make(chan struct{}),
+	}
+	if err := os.MkdirAll(s.resumeDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	completion, err := storage.NewDefaultPieceCompletionForDir(stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open piece completion: %v", err)
+	}
+	s.completion = completion
+
+	if s.scheduler, err = NewScheduler(conf.Schedule, nil); err != nil {
+		completion.Close()
+		return nil, err
+	}
+
+	if conf.GeoIPDatabase != "" {
+		if s.geoip, err = LoadGeoIP(conf.GeoIPDatabase); err != nil {
+			completion.Close()
+			return nil, err
+		}
+	}
+
+	// A missing file is a mistake, an unreachable URL is retried later
+	if conf.Blocklist != "" {
+		if err := s.ReloadBlocklist(); err != nil && !isURL(conf.Blocklist) {
+			completion.Close()
+			return nil, err
+		}
+	}
+
+	client, sockets, err := createTorrentClient(conf, dataDir, s.bandwidth, s.filter, newTrackerWatch(s.trackerResult))
+	if err != nil {
+		completion.Close()
+		return nil, fmt.Errorf("client creation failed: %v", err)
+	}
+	s.client = client
+	s.sockets = sockets
+
+	if conf.StreamAddress != "" {
+		if err := s.startStreamServer(); err != nil {
+			client.Close()
+			completion.Close()
+			return nil, err
+		}
+	}
+
+	s.restoreErrs = s.restore()
+	s.ApplySchedule()
+
+	if len(conf.Hooks) > 0 || len(conf.WatchDirs) > 0 {
+		if err := s.openLog(); err != nil {
+			client.Close()
+			completion.Close()
+			return nil, err
+		}
+	}
+	// Subscribed after restoring so hooks do not run again for old torrents
+	if len(conf.Hooks) > 0 {
+		s.wg.Add(1)
+		go s.hookLoop(s.Subscribe(EventFilter{}, 0))
+	}
+
+	s.wg.Add(6)
+	go s.saveLoop()
+	go s.eventLoop()
+	go s.throttleLoop()
+	go s.scheduleLoop()
+	go s.seedLoop()
+	go s.queueLoop()
+	if conf.Blocklist != "" {
+		s.wg.Add(1)
+		go s.blocklistLoop()
+	}
+	if s.iface != nil {
+		s.wg.Add(1)
+		go s.interfaceLoop()
+	}
+	if len(conf.WatchDirs) > 0 {
+		for _, w := range conf.WatchDirs {
+			if err := os.MkdirAll(w.Path, 0755); err != nil {
+				s.logf("watch %s: %v", w.Path, err)
+			}
+		}
+		s.wg.Add(1)
+		go s.watchDirLoop()
+	}
+
+	return s, nil
+}
+
+// Config returns the configuration the session was created with
+func (s *Session) Config() Config {
+	return s.config
+}
+
+// AddMagnet adds a magnet link to the session, returning the existing handle if already present
+func (s *Session) AddMagnet(magnetURI string, opts AddOptions) (*Handle, error) {
+	spec, err := torrent.TorrentSpecFromMagnetUri(magnetURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add magnet: %v", err)
+	}
+	selectOnly, err := selectOnlyRules(magnetURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add magnet: %v", err)
+	}
+	opts.Files = append(selectOnly, opts.Files...)
+	return s.addSpec(spec, magnetURI, opts, nil)
+}
+
+// AddTorrentFile adds a .torrent file to the session
+func (s *Session) AddTorrentFile(torrentPath string, opts AddOptions) (*Handle, error) {
+	mi, err := metainfo.LoadFromFile(torrentPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load torrent file: %v", err)
+	}
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load torrent file: %v", err)
+	}
+	return s.addSpec(spec, "", opts, nil)
+}
+
+// addSpec adds spec with storage rooted at the save path, seeding the
+// handle from r when restoring a previous run
+func (s *Session) addSpec(spec *torrent.TorrentSpec, magnet string, opts AddOptions, r *resumeData) (*Handle, error) {
+	moveOnComplete := false
+	if opts.SavePath == "" && r == nil {
+		switch {
+		case s.config.IncompleteDir != "":
+			opts.SavePath = s.config.IncompleteDir
+			moveOnComplete = true
+		case s.config.CompleteDir != "":
+			moveOnComplete = true
+		}
+	}
+	if err := opts.Limits.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.SeedGoal != nil {
+		if err := opts.SeedGoal.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Storage == "" {
+		opts.Storage = s.config.Storage
+	}
+	if err := opts.Storage.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.SavePath == "" {
+		opts.SavePath = s.dataDir
+	}
+	if err := os.MkdirAll(opts.SavePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create save directory: %v", err)
+	}
+
+	if h, ok := s.Torrent(spec.InfoHash.HexString()); ok {
+		return h, nil
+	}
+
+	st := newMovableStorage(opts.SavePath, s.storageOpener(opts.Storage))
+	spec.Storage = st
+	tor, _, err := s.client.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add torrent: %v", err)
+	}
+
+	h := &Handle{
+		session:        s,
+		tor:            tor,
+		magnet:         magnet,
+		savePath:       opts.SavePath,
+		labels:         append([]string(nil), opts.Labels...),
+		storage:        st,
+		storageKind:    opts.Storage,
+		moveOnComplete: moveOnComplete,
+		limits:         opts.Limits,
+		seedGoal:       opts.SeedGoal,
+		seedOnly:       opts.SeedOnly,
+		addedAt:        time.Now(),
+		startedAt:      time.Now(),
+		rates:          NewRateEstimator(),
+		pendingRules:   append([]FileRule(nil), opts.Files...),
+	}
+	if r != nil {
+		h.addedAt = time.Unix(r.AddedAt, 0)
+		if r.CompletedAt != 0 {
+			h.completedAt = time.Unix(r.CompletedAt, 0)
+		}
+		h.seed.seeding = time.Duration(r.SeedSeconds) * time.Second
+		h.seedOnly = r.SeedOnly
+		h.moveOnComplete = r.MoveOnComplete
+		h.sequential = r.Sequential
+		for _, i := range r.SequentialFiles {
+			if h.seqFiles == nil {
+				h.seqFiles = make(map[int]bool)
+			}
+			h.seqFiles[i] = true
+		}
+		h.uploadedBase = r.Uploaded
+		h.downloadedBase = r.Downloaded
+		for _, p := range r.Priorities {
+			h.priorities = append(h.priorities, Priority(p))
+		}
+	}
+	// Held until the queue gives the torrent a slot
+	h.paused = opts.Paused
+	h.queued = true
+	h.updateTransfer()
+
+	if tracked := s.track(h); tracked != h {
+		return tracked, nil
+	}
+	tor.SetOnWriteChunkError(h.onWriteError)
+	s.publish(TorrentAddedEvent{EventHeader: h.eventHeader(), Restored: r != nil})
+	if r == nil {
+		// Restored torrents wait until the saved queue order is back
+		s.updateQueue()
+	}
+	go h.watch()
+	return h, h.save()
+}
+
+// fileStorage returns file storage rooted at dir sharing the session piece completion
+func (s *Session) fileStorage(dir string) storage.ClientImpl {
+	return storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir:   dir,
+		PieceCompletion: s.completion,
+	})
+}
+
+// track registers h with the session and rebalances connection limits
+func (s *Session) track(h *Handle) *Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := h.InfoHash()
+	if existing, ok := s.handles[key]; ok {
+		return existing
+	}
+	s.handles[key] = h
+	s.queue = append(s.queue, key)
+	s.balanceConns()
+	return h
+}
+
+// watch waits for metadata to settle file priorities, then watches the
+// pieces until every wanted file has finished
+func (h *Handle) watch() {
+	select {
+	case <-h.tor.GotInfo():
+	case <-h.tor.Closed():
+		return
+	}
+
+	if err := h.initPriorities(); err != nil {
+		// Nothing is downloaded until the rules are fixed and it is resumed
+		h.fail(fmt.Errorf("file rules: %v", err))
+	}
+	h.applyPriorities()
+	h.prepareDisk()
+	h.save()
+	h.session.publish(MetadataEvent{EventHeader: h.eventHeader(), Files: len(h.tor.Files()), Size: h.tor.Length()})
+	h.watchPieces()
+}
+
+// watchPieces follows hash verdicts and finished files of a torrent with
+// metadata, then records when every wanted file has finished
+func (h *Handle) watchPieces() {
+	done := completeFiles(h.tor)
+
+	changes := h.tor.SubscribePieceStateChanges()
+	defer changes.Close()
+	recordPieces(h.InfoHash())
+	defer forgetPieces(h.InfoHash())
+
+	// hashing holds pieces seen being hashed, the first change after that
+	// neither checking nor marking the piece in storage carries the verdict
+	hashing := make(map[int]bool)
+	for !h.wantedComplete() {
+		select {
+		case change, ok := <-changes.Values:
+			if !ok {
+				return
+			}
+			if change.Checking || change.Marking {
+				hashing[change.Index] = true
+				continue
+			}
+			if hashing[change.Index] {
+				delete(hashing, change.Index)
+				sent := pieceContributors(h.InfoHash(), change.Index)
+				if !change.Complete && len(sent) > 0 {
+					h.noteOffenders(sent)
+					h.session.blameHashFail(h, sent)
+				}
+			}
+			if change.Complete {
+				h.publishCompleteFiles(change.Index, done)
+			}
+			if change.Complete && h.hasLowFiles() {
+				h.applyPriorities()
+			} else if change.Complete && h.hasSequential() {
+				h.applySequential()
+			}
+		case <-h.tor.Closed():
+			return
+		}
+	}
+
+	// The last piece completes the torrent before its change is read
+	h.publishCompleteFiles(-1, done)
+
+	h.mu.Lock()
+	completed := h.completedAt.IsZero()
+	if completed {
+		h.completedAt = time.Now()
+	}
+	move := h.moveOnComplete
+	h.moveOnComplete = false
+	h.mu.Unlock()
+
+	if move {
+		if err := h.MoveStorage(h.session.completeDir()); err != nil {
+			// Keep seeding from where the data is and retry after a restart
+			h.mu.Lock()
+			h.moveOnComplete = true
+			h.mu.Unlock()
+		}
+	}
+	h.save()
+	h.session.updateQueue()
+	if completed {
+		h.session.publish(TorrentCompletedEvent{EventHeader: h.eventHeader(), SavePath: h.SavePath(), Size: h.tor.Length()})
+	}
+}
+
+// Torrent looks up a handle by its hex info hash
+func (s *Session) Torrent(infoHash string) (*Handle, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.handles[infoHash]
+	return h, ok
+}
+
+// Torrents returns every handle in the session sorted by info hash
+func (s *Session) Torrents() []*Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.handles))
+	for k := range s.handles {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	handles := make([]*Handle, 0, len(keys))
+	for _, k := range keys {
+		handles = append(handles, s.handles[k])
+	}
+	return handles
+}
+
+// Remove drops a torrent from the session and forgets its resume state,
+// leaving its data on disk
+func (s *Session) Remove(infoHash string) error {
+	s.mu.Lock()
+	h, ok := s.handles[infoHash]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("torrent %s not found", infoHash)
+	}
+	h.mu.Lock()
+	h.removed = true
+	h.mu.Unlock()
+	h.tor.Drop()
+	delete(s.handles, infoHash)
+	for i, ih := range s.queue {
+		if ih == infoHash {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	s.balanceConns()
+	s.mu.Unlock()
+
+	// The freed slot goes to the next torrent in line
+	s.updateQueue()
+
+	h.saveMu.Lock()
+	defer h.saveMu.Unlock()
+	if err := os.Remove(s.resumePath(infoHash)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove resume data: %v", err)
+	}
+	return nil
+}
+
+// Close persists the state of every torrent and shuts down the client
+func (s *Session) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	if s.streamServer != nil {
+		s.streamServer.Close()
+	}
+
+	err := s.saveAll()
+	s.client.Close()
+	for _, st := range s.storages {
+		st.Close()
+	}
+	s.completion.Close()
+	s.events.close()
+	if s.logFile != nil {
+		s.logFile.Close()
+	}
+	return err
+}
+
+// balanceConns splits the global connection budget evenly across torrents.
+// The caller must hold s.mu.
+func (s *Session) balanceConns() {
+	if s.config.MaxConns <= 0 || len(s.handles) == 0 {
+		return
+	}
+
+	perTorrent := s.config.MaxConns / len(s.handles)
+	if perTorrent < 1 {
+		perTorrent = 1
+	}
+	if s.config.MaxConnsPerTorrent > 0 && perTorrent > s.config.MaxConnsPerTorrent {
+		perTorrent = s.config.MaxConnsPerTorrent
+	}
+	for _, h := range s.handles {
+		h.tor.SetMaxEstablishedConns(perTorrent)
+	}
+}
+
+// InfoHash returns the hex encoded info hash of the torrent
+func (h *Handle) InfoHash() string {
+	return h.tor.InfoHash().HexString()
+}
+
+// Torrent exposes the underlying anacrolix torrent
+func (h *Handle) Torrent() *torrent.Torrent {
+	return h.tor
+}
+
+// Name returns the torrent name, or the display name until metadata arrives
+func (h *Handle) Name() string {
+	return h.tor.Name()
+}
+
+// Progress reports torrent, file and piece progress with recent transfer rates
+func (h *Handle) Progress() ProgressInfo {
+	p := GetProgressInfo(h.tor, h.startedAt, h.rates)
+	p.Seeding = h.Seeding()
+	return p
+}
+
+// Peers lists the known peers of the torrent with their connection details and recent rates
+func (h *Handle) Peers() []PeerInfo {
+	h.rates.Sample(h.tor)
+	peers := getPeerInfo(h.tor, h.rates, h.session.geoip, h.session.bans)
+	listed := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		listed[p.Address] = true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for addr, ip := range h.offenders {
+		ban, ok := h.session.bans.reason(ip)
+		if !ok || listed[addr] {
+			continue
+		}
+		peers = append(peers, PeerInfo{
+			Address:     addr,
+			Country:     h.session.geoip.Country(ip),
+			PeerChoking: true,
+			HashFails:   h.session.bans.hashFails(ip),
+			Banned:      ban.Reason,
+		})
+	}
+	return peers
+}
+
+// SavePath returns the directory the torrent data is stored under
+func (h *Handle) SavePath() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.savePath
+}
+
+// Pause stops all data transfer for the torrent
+func (h *Handle) Pause() {
+	h.mu.Lock()
+	h.paused = true
+	h.mu.Unlock()
+
+	h.updateTransfer()
+	h.session.updateQueue()
+}
+
+// Resume restarts data transfer after Pause
+func (h *Handle) Resume() {
+	h.mu.Lock()
+	h.paused = false
+	h.err = nil
+	h.mu.Unlock()
+
+	if h.tor.Info() != nil && !h.prepareDisk() {
+		return
+	}
+
+	h.session.updateQueue()
+	h.updateTransfer()
+}
+
+// Paused reports whether the torrent has been paused
+func (h *Handle) Paused() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.paused
+}
+
+// Labels returns the labels attached to the torrent
+func (h *Handle) Labels() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.labels...)
+}
+
+// SetLabels replaces the labels attached to the torrent
+func (h *Handle) SetLabels(labels []string) {
+	h.mu.Lock()
+	h.labels = append([]string(nil), labels...)
+	h.mu.Unlock()
+	h.save()
+}
+
+// AddedAt returns when the torrent was first added, across restarts
+func (h *Handle) AddedAt() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.addedAt
+}
+
+// CompletedAt returns when the download finished, zero if it has not
+func (h *Handle) CompletedAt() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.completedAt
+}
+
+// Uploaded returns the payload bytes sent, across restarts
+func (h *Handle) Uploaded() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := h.tor.Stats()
+	return h.uploadedBase + stats.BytesWrittenData.Int64()
+}
+
+// Downloaded returns the payload bytes received, across restarts
+func (h *Handle) Downloaded() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := h.tor.Stats()
+	return h.downloadedBase + stats.BytesReadData.Int64()
+}
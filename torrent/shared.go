@@ -317,29 +317,230 @@ package torrent
 
 import (
 	"fmt"
-	"github.com/anacrolix/torrent"
+	"net"
 	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/iplist"
+	"github.com/serene-brew/ztorrent/proxy"
 )
 
-func createTorrentClient(dataDir string) (*torrent.Client, error) {
-	cfg := torrent.NewDefaultClientConfig()
-	cfg.Seed = false
-	cfg.Debug = false
-	cfg.NoDHT = false
-	cfg.DisablePEX = false
-	cfg.ListenPort = 0
+func createTorrentClient(conf Config, dataDir string, bw *bandwidth, blocked iplist.Ranger, trackers *trackerWatch) (*torrent.Client, *boundSockets, error) {
+	cfg, err := newClientConfig(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	// A listen interface binds outgoing connections too, including those to the proxy
+	var forward proxy.DialFunc
+	if conf.ListenInterface != "" {
+		forward = bindDialer(conf.ListenInterface)
+	}
+	peerDialer, err := applyProxy(cfg, conf.Proxy, forward)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sockets *boundSockets
+	if conf.ListenInterface != "" {
+		sockets, peerDialer = bindClient(cfg, conf, peerDialer)
+	}
+	if trackers != nil {
+		trackers.install(cfg)
+	}
+	if bw == nil {
+		bw = newBandwidth(conf)
+	}
+	cfg.DownloadRateLimiter = bw.down
+	cfg.UploadRateLimiter = bw.up
+	if blocked != nil {
+		cfg.IPBlocklist = blocked
+	}
 	if dataDir != "" {
 		cfg.DataDir = dataDir
 	}
+	// Sessions pick storage per torrent, only memory applies client wide
+	if conf.Storage == StorageMemory {
+		cfg.DefaultStorage = newMemoryStorage()
+	}
 
 	var client *torrent.Client
-	var err error
 	for retries := 0; retries < 3; retries++ {
 		client, err = torrent.NewClient(cfg)
 		if err == nil {
-			return client, nil
+			if peerDialer != nil {
+				client.AddDialer(peerDialer)
+			}
+			if sockets != nil {
+				if err := sockets.attach(client); err != nil {
+					client.Close()
+					return nil, nil, err
+				}
+			}
+			return client, sockets, nil
 		}
 		time.Sleep(time.Second)
 	}
-	return nil, fmt.Errorf("failed to create client after retries: %v", err)
+	return nil, nil, fmt.Errorf("failed to create client after retries: %v", err)
+}
+
+// Validate reports the first setting that cannot be applied to a client
+func (conf Config) Validate() error {
+	if conf.ListenPort < 0 || conf.ListenPort > 65535 {
+		return fmt.Errorf("listen_port %d is outside 0-65535", conf.ListenPort)
+	}
+	if conf.DisableTCP && conf.DisableUTP {
+		return fmt.Errorf("at least one of TCP and uTP must be enabled")
+	}
+	if conf.DisableIPv4 && conf.DisableIPv6 {
+		return fmt.Errorf("at least one of IPv4 and IPv6 must be enabled")
+	}
+	switch conf.Encryption {
+	case EncryptionPrefer, EncryptionRequire, EncryptionDisable, "":
+	default:
+		return fmt.Errorf("encryption must be one of prefer, require or disable, got %q", conf.Encryption)
+	}
+	if len(conf.PeerIDPrefix) > 20 {
+		return fmt.Errorf("peer_id_prefix %q is longer than 20 bytes", conf.PeerIDPrefix)
+	}
+	if conf.MaxConnsPerTorrent < 0 || conf.MaxConns < 0 || conf.MaxHalfOpenPerTorrent < 0 || conf.MaxHalfOpen < 0 {
+		return fmt.Errorf("connection limits cannot be negative")
+	}
+	if err := conf.Limits.Validate(); err != nil {
+		return err
+	}
+	if err := conf.AltLimits.Validate(); err != nil {
+		return fmt.Errorf("alt_limits: %v", err)
+	}
+	if err := conf.Schedule.Validate(); err != nil {
+		return err
+	}
+	if err := conf.SeedGoal.Validate(); err != nil {
+		return err
+	}
+	if conf.MaxActiveDownloads < 0 || conf.MaxActiveSeeds < 0 || conf.StalledMinutes < 0 {
+		return fmt.Errorf("queue limits cannot be negative")
+	}
+	if err := conf.Storage.Validate(); err != nil {
+		return err
+	}
+	if conf.BlocklistReloadMinutes < 0 {
+		return fmt.Errorf("blocklist_reload_minutes cannot be negative")
+	}
+	if conf.BanHashFails < 0 {
+		return fmt.Errorf("ban_hash_fails cannot be negative")
+	}
+	if err := conf.DiskCheck.Validate(); err != nil {
+		return err
+	}
+	if err := conf.Preallocate.Validate(); err != nil {
+		return err
+	}
+	if err := conf.Proxy.Validate(); err != nil {
+		return fmt.Errorf("proxy: %v", err)
+	}
+	for _, hk := range conf.Hooks {
+		if err := hk.Validate(); err != nil {
+			return err
+		}
+	}
+	if conf.HookTimeoutSeconds < 0 || conf.MaxHookJobs < 0 {
+		return fmt.Errorf("hook_timeout_seconds and max_hook_jobs cannot be negative")
+	}
+	for _, w := range conf.WatchDirs {
+		if err := w.Validate(); err != nil {
+			return err
+		}
+	}
+	if conf.WatchIntervalSeconds < 0 {
+		return fmt.Errorf("watch_interval_seconds cannot be negative")
+	}
+	return nil
+}
+
+// newClientConfig maps a Config onto the anacrolix client configuration
+func newClientConfig(conf Config) (*torrent.ClientConfig, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	cfg := torrent.NewDefaultClientConfig()
+	cfg.Seed = conf.Seed
+	cfg.Debug = conf.Debug
+	cfg.ListenPort = conf.ListenPort
+	cfg.NoDHT = conf.DisableDHT
+	cfg.DisablePEX = conf.DisablePEX
+	cfg.DisableTCP = conf.DisableTCP
+	cfg.DisableUTP = conf.DisableUTP
+	cfg.DisableIPv4 = conf.DisableIPv4
+	cfg.DisableIPv6 = conf.DisableIPv6
+	cfg.NoDefaultPortForwarding = conf.DisablePortForwarding
+	cfg.Callbacks.ReadMessage = countPeerMessage
+	cfg.Callbacks.PeerConnClosed = forgetPeer
+	cfg.Callbacks.CompletedHandshake = notePeerTorrent
+
+	switch conf.Encryption {
+	case EncryptionPrefer, "":
+		cfg.HeaderObfuscationPolicy = torrent.HeaderObfuscationPolicy{Preferred: true, RequirePreferred: false}
+	case EncryptionRequire:
+		cfg.HeaderObfuscationPolicy = torrent.HeaderObfuscationPolicy{Preferred: true, RequirePreferred: true}
+	case EncryptionDisable:
+		cfg.HeaderObfuscationPolicy = torrent.HeaderObfuscationPolicy{Preferred: false, RequirePreferred: true}
+	}
+
+	if conf.PeerIDPrefix != "" {
+		cfg.Bep20 = conf.PeerIDPrefix
+	}
+
+	if conf.MaxConnsPerTorrent > 0 {
+		cfg.EstablishedConnsPerTorrent = conf.MaxConnsPerTorrent
+	}
+	if conf.MaxHalfOpenPerTorrent > 0 {
+		cfg.HalfOpenConnsPerTorrent = conf.MaxHalfOpenPerTorrent
+	}
+	if conf.MaxHalfOpen > 0 {
+		cfg.TotalHalfOpenConns = conf.MaxHalfOpen
+	}
+
+	return cfg, nil
+}
+
+// listenHosts holds the per family addresses to bind for a listen interface
+type listenHosts struct {
+	ipv4 string
+	ipv6 string
+}
+
+// resolveListenInterface accepts either an IP address or an interface name
+func resolveListenInterface(name string) (listenHosts, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		if ip.To4() != nil {
+			return listenHosts{ipv4: ip.String()}, nil
+		}
+		return listenHosts{ipv6: ip.String()}, nil
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return listenHosts{}, fmt.Errorf("listen interface %q: %v", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return listenHosts{}, fmt.Errorf("listen interface %q: %v", name, err)
+	}
+
+	var hosts listenHosts
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil && hosts.ipv4 == "" {
+			hosts.ipv4 = ipNet.IP.String()
+		} else if ipNet.IP.To4() == nil && hosts.ipv6 == "" {
+			hosts.ipv6 = ipNet.IP.String()
+		}
+	}
+	if hosts.ipv4 == "" && hosts.ipv6 == "" {
+		return listenHosts{}, fmt.Errorf("listen interface %q has no usable address", name)
+	}
+	return hosts, nil
 }
@@ -0,0 +1,188 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// StorageKind selects where torrent data is kept
+type StorageKind string
+
+const (
+	StorageFile   StorageKind = "file"   // regular files under the save path
+	StorageMMap   StorageKind = "mmap"   // the same files, memory mapped
+	StorageBolt   StorageKind = "bolt"   // pieces in a bolt database in the save path
+	StorageSQLite StorageKind = "sqlite" // pieces in a SQLite database in the save path
+	StorageMemory StorageKind = "memory" // pieces in memory, lost on exit
+)
+
+// Validate rejects unknown storage kinds
+func (k StorageKind) Validate() error {
+	switch k {
+	case StorageFile, StorageMMap, StorageBolt, StorageSQLite, StorageMemory, "":
+		return nil
+	}
+	return fmt.Errorf("storage must be one of file, mmap, bolt, sqlite or memory, got %q", k)
+}
+
+// movable reports whether data of this kind lives in files MoveStorage can move
+func (k StorageKind) movable() bool {
+	return k == StorageFile || k == StorageMMap || k == ""
+}
+
+// torrentDeleter is a shared store that can drop the pieces of one torrent
+// while other torrents keep using it
+type torrentDeleter interface {
+	deleteTorrent(infoHash metainfo.Hash) error
+}
+
+// storageOpener returns the function opening storage of kind in a directory.
+// Database and memory stores are shared by every torrent using the same
+// directory and closed with the session.
+func (s *Session) storageOpener(kind StorageKind) func(dir string) (storage.ClientImpl, error) {
+	switch kind {
+	case StorageMMap:
+		return func(dir string) (storage.ClientImpl, error) {
+			return storage.NewMMapWithCompletion(dir, s.completion), nil
+		}
+	case StorageBolt:
+		return s.sharedStorage(kind, openBoltStorage)
+	case StorageSQLite:
+		return s.sharedStorage(kind, openSQLiteStorage)
+	case StorageMemory:
+		return s.sharedStorage(kind, func(string) (storage.ClientImplCloser, error) {
+			return newMemoryStorage(), nil
+		})
+	}
+	return func(dir string) (storage.ClientImpl, error) {
+		return s.fileStorage(dir), nil
+	}
+}
+
+// sharedStorage opens one store per kind and directory for the session lifetime
+func (s *Session) sharedStorage(kind StorageKind, open func(dir string) (storage.ClientImplCloser, error)) func(dir string) (storage.ClientImpl, error) {
+	return func(dir string) (storage.ClientImpl, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		key := string(kind) + ":" + dir
+		if st, ok := s.storages[key]; ok {
+			return st, nil
+		}
+		st, err := open(dir)
+		if err != nil {
+			return nil, err
+		}
+		s.storages[key] = st
+		return st, nil
+	}
+}
+
+// sqliteStorageFile is the name of the SQLite piece store in a save path
+const sqliteStorageFile = ".ztorrent-pieces.db"
+
+func sqliteStoragePath(dir string) string {
+	return filepath.Join(dir, sqliteStorageFile)
+}
+
+// memoryStorage keeps pieces in memory, for tests, previews and probes
+type memoryStorage struct {
+	mu     sync.Mutex
+	pieces map[metainfo.PieceKey]*memoryPiece
+}
+
+type memoryPiece struct {
+	mu       sync.Mutex
+	data     []byte
+	complete bool
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{pieces: make(map[metainfo.PieceKey]*memoryPiece)}
+}
+
+// OpenTorrent implements storage.ClientImpl
+func (m *memoryStorage) OpenTorrent(_ context.Context, _ *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	return storage.TorrentImpl{
+		Piece: func(p metainfo.Piece) storage.PieceImpl {
+			return m.piece(metainfo.PieceKey{InfoHash: infoHash, Index: p.Index()}, p.Length())
+		},
+		Close: func() error {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			for k := range m.pieces {
+				if k.InfoHash == infoHash {
+					delete(m.pieces, k)
+				}
+			}
+			return nil
+		},
+	}, nil
+}
+
+// Close implements storage.ClientImplCloser
+func (m *memoryStorage) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pieces = make(map[metainfo.PieceKey]*memoryPiece)
+	return nil
+}
+
+func (m *memoryStorage) piece(key metainfo.PieceKey, length int64) *memoryPiece {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pieces[key]
+	if !ok {
+		p = &memoryPiece{data: make([]byte, length)}
+		m.pieces[key] = p
+	}
+	return p
+}
+
+func (p *memoryPiece) ReadAt(b []byte, off int64) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if off >= int64(len(p.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, p.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (p *memoryPiece) WriteAt(b []byte, off int64) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if off+int64(len(b)) > int64(len(p.data)) {
+		return 0, fmt.Errorf("write past the end of the piece")
+	}
+	return copy(p.data[off:], b), nil
+}
+
+func (p *memoryPiece) MarkComplete() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.complete = true
+	return nil
+}
+
+func (p *memoryPiece) MarkNotComplete() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.complete = false
+	return nil
+}
+
+func (p *memoryPiece) Completion() storage.Completion {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return storage.Completion{Complete: p.complete, Ok: true}
+}
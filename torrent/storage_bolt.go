@@ -0,0 +1,188 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// boltStorage keeps pieces in a bolt database laid out like the anacrolix
+// bolt store, so stores written by earlier versions stay readable. Pieces are
+// split into chunks keyed by info hash, piece and chunk index.
+type boltStorage struct {
+	db *bbolt.DB
+}
+
+const boltChunkSize = 1 << 14
+
+var (
+	boltDataBucket       = []byte("data")
+	boltCompletionBucket = []byte("completion")
+)
+
+func openBoltStorage(dir string) (storage.ClientImplCloser, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(filepath.Join(dir, "bolt.db"), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt storage in %s: %v", dir, err)
+	}
+	db.NoSync = true
+	return &boltStorage{db: db}, nil
+}
+
+// OpenTorrent implements storage.ClientImpl
+func (s *boltStorage) OpenTorrent(_ context.Context, _ *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	return storage.TorrentImpl{
+		Piece: func(p metainfo.Piece) storage.PieceImpl {
+			return boltPiece{s.db, infoHash, p.Index()}
+		},
+		Close: func() error { return nil },
+	}, nil
+}
+
+// Close implements storage.ClientImplCloser
+func (s *boltStorage) Close() error {
+	return s.db.Close()
+}
+
+// deleteTorrent drops every chunk and completion record of infoHash
+func (s *boltStorage) deleteTorrent(infoHash metainfo.Hash) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if data := tx.Bucket(boltDataBucket); data != nil {
+			c := data.Cursor()
+			for k, _ := c.Seek(infoHash[:]); k != nil && bytes.HasPrefix(k, infoHash[:]); k, _ = c.Next() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		if completion := tx.Bucket(boltCompletionBucket); completion != nil {
+			err := completion.DeleteBucket(infoHash[:])
+			if err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type boltPiece struct {
+	db       *bbolt.DB
+	infoHash metainfo.Hash
+	index    int
+}
+
+func (p boltPiece) chunkKey(chunk int64) []byte {
+	key := make([]byte, 26)
+	copy(key, p.infoHash[:])
+	binary.BigEndian.PutUint32(key[20:], uint32(p.index))
+	binary.BigEndian.PutUint16(key[24:], uint16(chunk))
+	return key
+}
+
+func (p boltPiece) completionKey() []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uint32(p.index))
+	return key
+}
+
+func (p boltPiece) ReadAt(b []byte, off int64) (n int, err error) {
+	err = p.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(boltDataBucket)
+		if data == nil {
+			return io.EOF
+		}
+		chunk, off := off/boltChunkSize, off%boltChunkSize
+		for len(b) > 0 {
+			// A chunk of the wrong size cannot be trusted, so treat it as missing
+			stored := data.Get(p.chunkKey(chunk))
+			if len(stored) != boltChunkSize {
+				return io.EOF
+			}
+			n1 := copy(b, stored[off:])
+			b, n, off = b[n1:], n+n1, 0
+			chunk++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (p boltPiece) WriteAt(b []byte, off int64) (n int, err error) {
+	err = p.db.Update(func(tx *bbolt.Tx) error {
+		data, err := tx.CreateBucketIfNotExists(boltDataBucket)
+		if err != nil {
+			return err
+		}
+		chunk, off := off/boltChunkSize, off%boltChunkSize
+		for len(b) > 0 {
+			key := p.chunkKey(chunk)
+			buf := make([]byte, boltChunkSize)
+			copy(buf, data.Get(key))
+			n1 := copy(buf[off:], b)
+			if err := data.Put(key, buf); err != nil {
+				return err
+			}
+			b, n, off = b[n1:], n+n1, 0
+			chunk++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (p boltPiece) setComplete(complete bool) error {
+	value := []byte("i")
+	if complete {
+		value = []byte("c")
+	}
+	return p.db.Update(func(tx *bbolt.Tx) error {
+		completion, err := tx.CreateBucketIfNotExists(boltCompletionBucket)
+		if err != nil {
+			return err
+		}
+		pieces, err := completion.CreateBucketIfNotExists(p.infoHash[:])
+		if err != nil {
+			return err
+		}
+		return pieces.Put(p.completionKey(), value)
+	})
+}
+
+func (p boltPiece) MarkComplete() error    { return p.setComplete(true) }
+func (p boltPiece) MarkNotComplete() error { return p.setComplete(false) }
+
+func (p boltPiece) Completion() storage.Completion {
+	var c storage.Completion
+	c.Err = p.db.View(func(tx *bbolt.Tx) error {
+		completion := tx.Bucket(boltCompletionBucket)
+		if completion == nil {
+			return nil
+		}
+		pieces := completion.Bucket(p.infoHash[:])
+		if pieces == nil {
+			return nil
+		}
+		switch string(pieces.Get(p.completionKey())) {
+		case "c":
+			c.Complete, c.Ok = true, true
+		case "i":
+			c.Ok = true
+		}
+		return nil
+	})
+	return c
+}
@@ -0,0 +1,14 @@
+//go:build !cgo
+
+package torrent
+
+import (
+	"fmt"
+
+	"github.com/anacrolix/torrent/storage"
+)
+
+// openSQLiteStorage needs cgo, like the SQLite support in anacrolix
+func openSQLiteStorage(dir string) (storage.ClientImplCloser, error) {
+	return nil, fmt.Errorf("sqlite storage is not available in builds without cgo")
+}
@@ -0,0 +1,159 @@
+//go:build cgo
+
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	sqlite "github.com/go-llsqlite/adapter"
+	"github.com/go-llsqlite/adapter/sqlitex"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// sqliteStorage keeps every piece as a blob row of a single SQLite database
+type sqliteStorage struct {
+	mu   sync.Mutex
+	conn *sqlite.Conn
+}
+
+func openSQLiteStorage(dir string) (storage.ClientImplCloser, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	conn, err := sqlite.OpenConn(sqliteStoragePath(dir), 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite storage in %s: %v", dir, err)
+	}
+	err = sqlitex.ExecScript(conn, `
+		pragma journal_mode=wal;
+		create table if not exists pieces(
+			infohash text not null,
+			"index" integer not null,
+			data blob not null,
+			complete integer not null default 0,
+			unique(infohash, "index")
+		);`)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open sqlite storage in %s: %v", dir, err)
+	}
+	return &sqliteStorage{conn: conn}, nil
+}
+
+// OpenTorrent implements storage.ClientImpl
+func (s *sqliteStorage) OpenTorrent(_ context.Context, _ *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	return storage.TorrentImpl{
+		Piece: func(p metainfo.Piece) storage.PieceImpl {
+			return sqlitePiece{s, infoHash.HexString(), p.Index(), p.Length()}
+		},
+		Close: func() error { return nil },
+	}, nil
+}
+
+// Close implements storage.ClientImplCloser
+func (s *sqliteStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.Close()
+}
+
+// deleteTorrent drops every piece row of infoHash
+func (s *sqliteStorage) deleteTorrent(infoHash metainfo.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sqlitex.Exec(s.conn, `delete from pieces where infohash=?`, nil, infoHash.HexString())
+}
+
+type sqlitePiece struct {
+	s        *sqliteStorage
+	infoHash string
+	index    int
+	length   int64
+}
+
+// rowid returns the row of the piece, creating a zeroed blob when create is set
+func (p sqlitePiece) rowid(create bool) (int64, bool, error) {
+	if create {
+		err := sqlitex.Exec(p.s.conn,
+			`insert or ignore into pieces(infohash, "index", data) values(?, ?, zeroblob(?))`,
+			nil, p.infoHash, p.index, p.length)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	var rowid int64
+	found := false
+	err := sqlitex.Exec(p.s.conn,
+		`select rowid from pieces where infohash=? and "index"=?`,
+		func(stmt *sqlite.Stmt) error {
+			rowid, found = stmt.ColumnInt64(0), true
+			return nil
+		}, p.infoHash, p.index)
+	return rowid, found, err
+}
+
+func (p sqlitePiece) ReadAt(b []byte, off int64) (int, error) {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+
+	rowid, found, err := p.rowid(false)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, io.EOF
+	}
+	blob, err := p.s.conn.OpenBlob("main", "pieces", "data", rowid, false)
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+	return blob.ReadAt(b, off)
+}
+
+func (p sqlitePiece) WriteAt(b []byte, off int64) (int, error) {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+
+	rowid, _, err := p.rowid(true)
+	if err != nil {
+		return 0, err
+	}
+	blob, err := p.s.conn.OpenBlob("main", "pieces", "data", rowid, true)
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+	return blob.WriteAt(b, off)
+}
+
+func (p sqlitePiece) setComplete(complete bool) error {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	return sqlitex.Exec(p.s.conn,
+		`update pieces set complete=? where infohash=? and "index"=?`,
+		nil, complete, p.infoHash, p.index)
+}
+
+func (p sqlitePiece) MarkComplete() error    { return p.setComplete(true) }
+func (p sqlitePiece) MarkNotComplete() error { return p.setComplete(false) }
+
+func (p sqlitePiece) Completion() storage.Completion {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+
+	c := storage.Completion{Ok: true}
+	c.Err = sqlitex.Exec(p.s.conn,
+		`select complete from pieces where infohash=? and "index"=?`,
+		func(stmt *sqlite.Stmt) error {
+			c.Complete = stmt.ColumnInt(0) != 0
+			return nil
+		}, p.infoHash, p.index)
+	return c
+}
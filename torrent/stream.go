@@ -0,0 +1,187 @@
+package torrent
+
+import (
+	"fmt"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/types"
+)
+
+// defaultReadahead is how far ahead of a reader, or of the first missing
+// piece in sequential mode, pieces are prioritised
+const defaultReadahead = 8 << 20
+
+// readahead returns the configured readahead in bytes
+func (s *Session) readahead() int64 {
+	if s.config.StreamReadahead > 0 {
+		return s.config.StreamReadahead
+	}
+	return defaultReadahead
+}
+
+// NewFileReader opens file index for streaming. Reads block until the
+// pieces they need arrive, which are fetched ahead of everything else
+// together with the readahead after them; seeking moves that window.
+func (h *Handle) NewFileReader(index int) (torrent.Reader, error) {
+	if h.tor.Info() == nil {
+		return nil, fmt.Errorf("metadata for %s is not available yet", h.InfoHash())
+	}
+	files := h.tor.Files()
+	if index < 0 || index >= len(files) {
+		return nil, fmt.Errorf("file index %d out of range, torrent has %d files", index, len(files))
+	}
+	r := files[index].NewReader()
+	r.SetReadahead(h.session.readahead())
+	return r, nil
+}
+
+// SetSequential downloads every wanted file of the torrent in order
+func (h *Handle) SetSequential(on bool) error {
+	h.mu.Lock()
+	h.sequential = on
+	h.mu.Unlock()
+	h.applySequential()
+	return h.save()
+}
+
+// Sequential reports whether the whole torrent downloads in order
+func (h *Handle) Sequential() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sequential
+}
+
+// SetFileSequential downloads a single file in order, ahead of the rest
+func (h *Handle) SetFileSequential(index int, on bool) error {
+	// Without metadata the index cannot be checked, one out of range is
+	// ignored once the file list is known
+	if h.tor.Info() != nil {
+		if n := len(h.tor.Files()); index < 0 || index >= n {
+			return fmt.Errorf("file index %d out of range, torrent has %d files", index, n)
+		}
+	}
+	h.mu.Lock()
+	if h.seqFiles == nil {
+		h.seqFiles = make(map[int]bool)
+	}
+	if on {
+		h.seqFiles[index] = true
+	} else {
+		delete(h.seqFiles, index)
+	}
+	h.mu.Unlock()
+	h.applySequential()
+	return h.save()
+}
+
+// hasSequential reports whether any part of the torrent downloads in order
+func (h *Handle) hasSequential() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sequential || len(h.seqFiles) > 0
+}
+
+// FileSequential reports whether file index downloads in order
+func (h *Handle) FileSequential(index int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sequential || h.seqFiles[index]
+}
+
+// applySequential raises the first missing pieces of every sequential range
+// above the file priorities and lowers pieces raised before that are done
+// or no longer wanted
+func (h *Handle) applySequential() {
+	if h.tor.Info() == nil {
+		return
+	}
+	files := h.tor.Files()
+	prios := h.FilePriorities()
+	pieceLen := h.tor.Info().PieceLength
+	window := int((h.session.readahead() + pieceLen - 1) / pieceLen)
+	if window < 2 {
+		window = 2
+	}
+
+	h.mu.Lock()
+	// Ranges are keyed by file index, or -1 for the whole torrent
+	ranges := make(map[int][]*torrent.File)
+	if h.sequential {
+		var wanted []*torrent.File
+		for i, f := range files {
+			if i < len(prios) && prios[i] != PrioritySkip {
+				wanted = append(wanted, f)
+			}
+		}
+		ranges[-1] = wanted
+	}
+	for i := range h.seqFiles {
+		if i >= 0 && i < len(files) {
+			ranges[i] = []*torrent.File{files[i]}
+		}
+	}
+	if h.seqCursors == nil {
+		h.seqCursors = make(map[int]int)
+	}
+	cursors := make(map[int]int)
+	for k := range ranges {
+		cursors[k] = h.seqCursors[k]
+	}
+	previous := h.seqPieces
+	h.mu.Unlock()
+
+	raised := make(map[int]types.PiecePriority)
+	for k, r := range ranges {
+		next := firstMissingPieces(h.tor, r, window, cursors[k])
+		if len(next) > 0 {
+			cursors[k] = next[0]
+		}
+		for j, p := range next {
+			prio := types.PiecePriorityReadahead
+			if j == 0 {
+				prio = types.PiecePriorityNext
+			}
+			if prio > raised[p] {
+				raised[p] = prio
+			}
+		}
+	}
+
+	for p := range previous {
+		if _, ok := raised[p]; !ok {
+			h.tor.Piece(p).SetPriority(types.PiecePriorityNone)
+		}
+	}
+	for p, prio := range raised {
+		h.tor.Piece(p).SetPriority(prio)
+	}
+
+	h.mu.Lock()
+	h.seqPieces = raised
+	h.seqCursors = cursors
+	h.mu.Unlock()
+}
+
+// firstMissingPieces returns up to n incomplete pieces of files in order,
+// skipping pieces before from which are known to be complete
+func firstMissingPieces(tor *torrent.Torrent, files []*torrent.File, n, from int) []int {
+	var pieces []int
+	seen := make(map[int]bool)
+	for _, f := range files {
+		start := f.BeginPieceIndex()
+		if start < from {
+			start = from
+		}
+		for p := start; p < f.EndPieceIndex(); p++ {
+			if seen[p] || tor.Piece(p).State().Complete {
+				continue
+			}
+			seen[p] = true
+			pieces = append(pieces, p)
+			if len(pieces) == n {
+				return pieces
+			}
+		}
+	}
+	return pieces
+}
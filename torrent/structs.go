@@ -1,13 +1,123 @@
 package torrent
 
-import "time"
+import (
+	"time"
+
+	"github.com/serene-brew/ztorrent/proxy"
+)
+
+// EncryptionPolicy selects how peer connections use header obfuscation (MSE/PE)
+type EncryptionPolicy string
+
+const (
+	EncryptionPrefer  EncryptionPolicy = "prefer"
+	EncryptionRequire EncryptionPolicy = "require"
+	EncryptionDisable EncryptionPolicy = "disable"
+)
 
 // Config holds the configuration for torrent operations
 type Config struct {
-	Timeout      time.Duration
-	Debug        bool
-	ShowProgress bool
-	Seed         bool
+	Timeout      time.Duration `json:"-"`
+	Debug        bool          `json:"debug"`
+	ShowProgress bool          `json:"-"`
+	Seed         bool          `json:"seed"`
+
+	// Resume state, empty uses DefaultStateDir
+	StateDir string `json:"state_dir"`
+
+	// Network. ListenInterface is an interface name or IP address, such as a
+	// VPN tunnel, that listening and outgoing connections bind to. Torrents
+	// are held while it is down or missing, and the sockets move when its
+	// address changes. Empty binds all.
+	ListenPort      int    `json:"listen_port"` // 0 lets the system pick a free port
+	ListenInterface string `json:"listen_interface"`
+	DisableIPv4     bool   `json:"disable_ipv4"`
+	DisableIPv6     bool   `json:"disable_ipv6"`
+	DisableTCP      bool   `json:"disable_tcp"`
+	DisableUTP      bool   `json:"disable_utp"`
+
+	// Peer discovery
+	DisableDHT bool `json:"disable_dht"`
+	DisablePEX bool `json:"disable_pex"`
+
+	// Encryption and NAT traversal
+	Encryption            EncryptionPolicy `json:"encryption"`
+	DisablePortForwarding bool             `json:"disable_port_forwarding"` // UPnP and NAT-PMP
+
+	// Identity
+	PeerIDPrefix string `json:"peer_id_prefix"` // BEP 20 style prefix, e.g. "-ZT0001-"
+
+	// Connection limits, zero keeps the anacrolix default
+	MaxConnsPerTorrent    int `json:"max_conns_per_torrent"`
+	MaxConns              int `json:"max_conns"` // spread across all torrents of a session
+	MaxHalfOpenPerTorrent int `json:"max_half_open_per_torrent"`
+	MaxHalfOpen           int `json:"max_half_open"`
+
+	// GeoIPDatabase is a CSV of "first IP,last IP,country code" ranges such as
+	// the DB-IP lite country file, empty leaves peer countries blank
+	GeoIPDatabase string `json:"geoip_database"`
+
+	// Global transfer limits, AltLimits replace Limits while alt speed mode is on
+	Limits    Limits `json:"limits"`
+	AltLimits Limits `json:"alt_limits"`
+
+	// Schedule switches limits and pauses torrents by time of week
+	Schedule Schedule `json:"schedule"`
+
+	// SeedGoal stops seeding completed torrents, torrents may override it
+	SeedGoal SeedGoal `json:"seed_goal"`
+
+	// Queue limits, zero is unlimited. Torrents without transfer for
+	// StalledMinutes do not count against them, zero disables that.
+	MaxActiveDownloads int `json:"max_active_downloads"`
+	MaxActiveSeeds     int `json:"max_active_seeds"`
+	StalledMinutes     int `json:"stalled_minutes"`
+
+	// StreamReadahead is how many bytes ahead of a stream reader or of
+	// sequential downloads to prioritise, zero uses 8 MiB
+	StreamReadahead int64 `json:"stream_readahead"`
+	// StreamAddress is where the HTTP stream server listens, e.g.
+	// "127.0.0.1:8090", empty disables it
+	StreamAddress string `json:"stream_address"`
+
+	// IncompleteDir holds torrents while they download and CompleteDir
+	// receives them once done, either may be empty to use the data directory
+	IncompleteDir string `json:"incomplete_dir"`
+	CompleteDir   string `json:"complete_dir"`
+
+	// Storage is where torrent data is kept unless a torrent picks its own
+	Storage StorageKind `json:"storage"`
+
+	// DiskCheck compares free space with the selected files once metadata
+	// is known, Preallocate creates those files before downloading
+	DiskCheck   DiskCheck     `json:"disk_check"`
+	Preallocate Preallocation `json:"preallocate"`
+
+	// BanHashFails bans a peer for the session once that many pieces it
+	// sent failed the hash check. Zero disables these bans, anacrolix still
+	// bans a peer that alone sent a bad piece.
+	BanHashFails int `json:"ban_hash_fails"`
+
+	// Blocklist is a file or http(s) URL of IP ranges to refuse, reloaded
+	// when the file changes and every BlocklistReloadMinutes
+	Blocklist              string `json:"blocklist"`
+	BlocklistReloadMinutes int    `json:"blocklist_reload_minutes"`
+
+	// Proxy carries peer and tracker connections, and in proxy only mode
+	// blocklist downloads, through a SOCKS5 or HTTP proxy
+	Proxy proxy.Config `json:"proxy"`
+
+	// Hooks run commands on session events, at most MaxHookJobs at a time
+	// (zero for no limit), with their output written to LogFile
+	Hooks              []Hook `json:"hooks"`
+	HookTimeoutSeconds int    `json:"hook_timeout_seconds"` // zero for no timeout
+	MaxHookJobs        int    `json:"max_hook_jobs"`
+	LogFile            string `json:"log_file"` // defaults to ztorrent.log in the state directory
+
+	// WatchDirs are polled every WatchIntervalSeconds for new .torrent and
+	// magnet files to add
+	WatchDirs            []WatchDir `json:"watch_dirs"`
+	WatchIntervalSeconds int        `json:"watch_interval_seconds"`
 }
 
 // DefaultConfig returns default configuration values
@@ -16,17 +126,72 @@ func DefaultConfig() Config {
 		Timeout:      2 * time.Minute,
 		Debug:        false,
 		ShowProgress: true,
-		Seed:         false,
+		Seed:         true,
+		ListenPort:   0,
+		Encryption:   EncryptionPrefer,
+		SeedGoal: SeedGoal{
+			Ratio:       2,
+			IdleMinutes: 30,
+			Action:      SeedPause,
+		},
+		MaxActiveDownloads: 3,
+		MaxActiveSeeds:     5,
+		StalledMinutes:     5,
+		Storage:            StorageFile,
+		DiskCheck:          DiskCheckRefuse,
+		Preallocate:        PreallocateNone,
+		BanHashFails:       3,
+
+		BlocklistReloadMinutes: 24 * 60,
+		Proxy:                  proxy.Default(),
+		HookTimeoutSeconds:     5 * 60,
+		MaxHookJobs:            2,
+		WatchIntervalSeconds:   5,
 	}
 }
 
+// AddOptions controls how a torrent is added to a Session
+type AddOptions struct {
+	SavePath string // defaults to the session data directory
+	Paused   bool
+	Labels   []string
+	Limits   Limits      // per torrent, on top of the global limits
+	SeedGoal *SeedGoal   // nil uses the session seed goal
+	Files    []FileRule  // applied in order once metadata is known
+	Storage  StorageKind // empty uses the session storage
+	SeedOnly bool        // the data already exists, never download
+}
+
+// Priority controls whether and how eagerly a file is downloaded
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow           // fetched only after every normal and high file is done
+	PriorityNormal
+	PriorityHigh
+)
+
+// FileRule assigns a priority to the files it matches. Exactly one of Glob,
+// Ext or Index is used, checked in that order.
+type FileRule struct {
+	Glob     string // matched against the file path and its base name
+	Ext      string // matched against FileInfo.Type, e.g. "mkv"
+	Index    int
+	Through  int // with Index, the last file of a range whose indices past the last file are ignored
+	Priority Priority
+}
+
 // FileInfo holds information about a single file
 type FileInfo struct {
-	Name     string
-	Size     int64
-	Type     string
-	Path     string
-	Complete bool
+	Index      int
+	Name       string
+	Size       int64
+	Type       string
+	Path       string
+	Complete   bool
+	Priority   Priority
+	Sequential bool // downloaded in order, ahead of other files
 }
 
 // TorrentInfo holds comprehensive torrent information
@@ -40,9 +205,34 @@ type TorrentInfo struct {
 
 // PeerInfo holds peer connection information
 type PeerInfo struct {
-	Address string
-	Active  bool
-	Stats   PeerStats
+	Address      string
+	Active       bool
+	Stats        PeerStats
+	DownloadRate float64 // smoothed, bytes per second
+	UploadRate   float64
+
+	// Identity, Client is empty until the peer handshake completes
+	PeerID  string
+	Client  string
+	Country string // ISO code when a GeoIP database is configured
+
+	// Connection, only meaningful for active peers
+	Network    string // TCP, uTP or WebRTC
+	Incoming   bool
+	Encryption string // encrypted or plain, as negotiated by the connection
+	Source     string // tracker, dht, pex, magnet, incoming or holepunch
+
+	// Choking and interest as announced by the peer
+	PeerChoking    bool
+	PeerInterested bool
+
+	// Progress is the share of pieces the peer has, 0 to 100
+	Progress float64
+
+	// HashFails counts pieces from the peer that failed the hash check and
+	// Banned is why the peer is refused, empty unless it is
+	HashFails int
+	Banned    string
 }
 
 // PeerStats holds peer statistics
@@ -57,7 +247,56 @@ type ProgressInfo struct {
 	Completed   int64
 	Total       int64
 	Percentage  float64
-	Speed       float64
+	Speed       float64 // recent download payload rate, see Rates
 	TimeElapsed float64
-	ETA         float64
+	ETA         float64 // seconds at the recent rate, -1 while stalled
+	Rates       Rates
+	Seeding     bool  // complete and uploading until the seed goal is reached
+	Err         error // set on the last update when the download could not go on
+
+	Files        []FileProgress
+	Pieces       PieceMap
+	Availability []int // number of connected peers that have each piece
+}
+
+// FileProgress holds download progress for a single file
+type FileProgress struct {
+	Index      int
+	Path       string
+	Completed  int64
+	Size       int64
+	Percentage float64
+	Complete   bool
+}
+
+// TorrentState is where a torrent of a Session is in its lifecycle
+type TorrentState int
+
+const (
+	StateDownloading TorrentState = iota
+	StateSeeding
+	StateComplete // finished and not seeding
+	StateStalled  // running without transfer, not counted by the queue
+	StateQueued   // waiting for a slot under the active limits
+	StatePaused
+	StateChecking
+	StateMoving
+	StateError   // paused by a problem such as a full disk, see Handle.Err
+	StateOffline // held while the listen interface is down
+)
+
+// PieceStatus is the state of a single piece
+type PieceStatus byte
+
+const (
+	PieceMissing PieceStatus = iota
+	PiecePartial
+	PieceHave
+	PieceChecking
+)
+
+// PieceMap packs the status of every piece into two bits
+type PieceMap struct {
+	n    int
+	bits []byte
 }
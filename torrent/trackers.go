@@ -0,0 +1,271 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/serene-brew/ztorrent/proxy"
+)
+
+// UDP tracker actions, BEP 15
+const (
+	udpActionAnnounce = 1
+	udpActionError    = 3
+)
+
+// trackerWatch reports the outcome of announces per tracker. anacrolix keeps
+// announce results private, so they are read off the hooks it offers:
+// LookupTrackerIp sees the URL of every announce, HTTP announces dial through
+// TrackerDialContext with a context the request director tagged, and UDP
+// announces use sockets from TrackerListenPacket whose packets carry the
+// info hash and the error a tracker answers with.
+type trackerWatch struct {
+	// report is called with a nil err when the tracker was reached, and an
+	// empty infoHash when every torrent using the tracker is affected
+	report func(infoHash, tracker string, err error)
+
+	mu   sync.Mutex
+	urls map[string]string // announce URL by the host:port it is reached at
+}
+
+// announceTag marks the context of an HTTP announce
+type announceTag struct {
+	infoHash string
+	tracker  string
+}
+
+func newTrackerWatch(report func(infoHash, tracker string, err error)) *trackerWatch {
+	return &trackerWatch{report: report, urls: make(map[string]string)}
+}
+
+// install wraps the tracker hooks of cfg, keeping what was set before
+func (w *trackerWatch) install(cfg *torrent.ClientConfig) {
+	lookup := cfg.LookupTrackerIp
+	if lookup == nil {
+		// What anacrolix does without one
+		lookup = func(u *url.URL) ([]net.IP, error) { return net.LookupIP(u.Hostname()) }
+	}
+	cfg.LookupTrackerIp = w.lookup(lookup)
+
+	director := cfg.HttpRequestDirector
+	cfg.HttpRequestDirector = func(req *http.Request) error {
+		if director != nil {
+			if err := director(req); err != nil {
+				return err
+			}
+		}
+		w.tag(req)
+		return nil
+	}
+
+	dial := proxy.DialFunc(cfg.TrackerDialContext)
+	if dial == nil {
+		d := &net.Dialer{Timeout: 30 * time.Second}
+		dial = d.DialContext
+	}
+	cfg.TrackerDialContext = w.dial(dial)
+
+	listen := cfg.TrackerListenPacket
+	if listen == nil {
+		listen = net.ListenPacket
+	}
+	cfg.TrackerListenPacket = func(network, addr string) (net.PacketConn, error) {
+		pc, err := listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &trackerPacketConn{PacketConn: pc, w: w}, nil
+	}
+}
+
+// lookup reports trackers whose name does not resolve and remembers the
+// addresses of those that do
+func (w *trackerWatch) lookup(lookup func(*url.URL) ([]net.IP, error)) func(*url.URL) ([]net.IP, error) {
+	return func(u *url.URL) ([]net.IP, error) {
+		// anacrolix announces UDP trackers once per address family, as udp4
+		// and udp6
+		announce := *u
+		if announce.Scheme == "udp4" || announce.Scheme == "udp6" {
+			announce.Scheme = "udp"
+		}
+		tracker := announce.String()
+		ips, err := lookup(u)
+		if err != nil {
+			w.report("", tracker, err)
+			return nil, err
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.urls[u.Host] = tracker
+		if port := u.Port(); port != "" {
+			for _, ip := range ips {
+				w.urls[net.JoinHostPort(ip.String(), port)] = tracker
+			}
+		}
+		return ips, nil
+	}
+}
+
+// tracker returns the announce URL reached at addr, empty when unknown
+func (w *trackerWatch) tracker(addr string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.urls[addr]
+}
+
+// tag puts the tracker and info hash of an HTTP announce in its context
+func (w *trackerWatch) tag(req *http.Request) {
+	tracker := w.tracker(req.URL.Host)
+	if tracker == "" {
+		return
+	}
+	tag := announceTag{tracker: tracker}
+	if ih := req.URL.Query().Get("info_hash"); len(ih) == 20 {
+		tag.infoHash = hex.EncodeToString([]byte(ih))
+	}
+	*req = *req.WithContext(context.WithValue(req.Context(), announceTag{}, tag))
+}
+
+// dial reports whether the tracker of a tagged announce could be reached
+func (w *trackerWatch) dial(dial proxy.DialFunc) proxy.DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		tag, ok := ctx.Value(announceTag{}).(announceTag)
+		switch {
+		case !ok:
+		case err == nil:
+			w.report(tag.infoHash, tag.tracker, nil)
+		case ctx.Err() == nil:
+			// A cancelled announce says nothing about the tracker
+			w.report(tag.infoHash, tag.tracker, err)
+		}
+		return conn, err
+	}
+}
+
+// trackerPacketConn follows the requests of one UDP announce
+type trackerPacketConn struct {
+	net.PacketConn
+	w *trackerWatch
+
+	mu       sync.Mutex
+	tracker  string
+	infoHash string
+	waiting  bool // a request was sent and not answered yet
+}
+
+func (c *trackerPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tracker := c.w.tracker(addr.String())
+	infoHash := ""
+	if len(b) >= 36 && binary.BigEndian.Uint32(b[8:12]) == udpActionAnnounce {
+		infoHash = hex.EncodeToString(b[16:36])
+	}
+	n, err := c.PacketConn.WriteTo(b, addr)
+
+	c.mu.Lock()
+	c.tracker = tracker
+	if infoHash != "" {
+		c.infoHash = infoHash
+	}
+	infoHash = c.infoHash
+	c.waiting = err == nil
+	c.mu.Unlock()
+	if err != nil && tracker != "" {
+		c.w.report(infoHash, tracker, err)
+	}
+	return n, err
+}
+
+func (c *trackerPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil || n < 8 {
+		return n, addr, err
+	}
+	c.mu.Lock()
+	tracker, infoHash := c.tracker, c.infoHash
+	c.waiting = false
+	c.mu.Unlock()
+	if tracker == "" {
+		return n, addr, err
+	}
+	switch binary.BigEndian.Uint32(b[:4]) {
+	case udpActionAnnounce:
+		c.w.report(infoHash, tracker, nil)
+	case udpActionError:
+		c.w.report(infoHash, tracker, errors.New(string(b[8:n])))
+	}
+	return n, addr, err
+}
+
+// Close reports a request the tracker never answered, anacrolix closes the
+// socket once the announce timed out
+func (c *trackerPacketConn) Close() error {
+	c.mu.Lock()
+	waiting, tracker, infoHash := c.waiting, c.tracker, c.infoHash
+	c.waiting = false
+	c.mu.Unlock()
+	if waiting && tracker != "" {
+		c.w.report(infoHash, tracker, errors.New("tracker did not answer"))
+	}
+	return c.PacketConn.Close()
+}
+
+// trackerResult records the outcome of an announce to tracker, publishing
+// an event when a torrent gets an error it did not have
+func (s *Session) trackerResult(infoHash, tracker string, err error) {
+	var handles []*Handle
+	if infoHash != "" {
+		if h, ok := s.Torrent(infoHash); ok {
+			handles = append(handles, h)
+		}
+	} else {
+		for _, h := range s.Torrents() {
+			if h.usesTracker(tracker) {
+				handles = append(handles, h)
+			}
+		}
+	}
+
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	for _, h := range handles {
+		h.mu.Lock()
+		previous := h.trackerErrs[tracker]
+		if msg == "" {
+			delete(h.trackerErrs, tracker)
+		} else {
+			if h.trackerErrs == nil {
+				h.trackerErrs = make(map[string]string)
+			}
+			h.trackerErrs[tracker] = msg
+		}
+		h.mu.Unlock()
+
+		if msg != "" && msg != previous {
+			s.publish(TrackerErrorEvent{EventHeader: h.eventHeader(), Tracker: tracker, Message: msg})
+		}
+	}
+}
+
+// usesTracker reports whether tracker is in the announce list of h
+func (h *Handle) usesTracker(tracker string) bool {
+	mi := h.tor.Metainfo()
+	for _, tier := range mi.UpvertedAnnounceList() {
+		for _, t := range tier {
+			if u, err := url.Parse(t); err == nil && u.String() == tracker {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"fmt"
+	"net/netip"
 	"net/url"
 	"strings"
 	"time"
@@ -109,22 +110,29 @@ func GetTorrentInfo(tor *torrent.Torrent) (*TorrentInfo, error) {
 
 	if len(info.Files) == 0 {
 		// Single file torrent
-		torInfo.Files = append(torInfo.Files, FileInfo{
-			Name: info.Name,
-			Size: info.Length,
-			Type: getFileExtension(info.Name),
-			Path: info.Name,
-		})
+		fileInfo := FileInfo{
+			Name:     info.Name,
+			Size:     info.Length,
+			Type:     getFileExtension(info.Name),
+			Path:     info.Name,
+			Priority: PriorityNormal,
+		}
+		fileInfo.Complete = fileComplete(tor, 0)
+		torInfo.Files = append(torInfo.Files, fileInfo)
+		torInfo.FilesByExt[fileInfo.Type] = append(torInfo.FilesByExt[fileInfo.Type], fileInfo)
 	} else {
 		// Multiple files torrent
-		for _, file := range info.Files {
+		for i, file := range info.Files {
 			path := append([]string{info.Name}, file.Path...)
 			fullPath := joinPath(path)
 			fileInfo := FileInfo{
-				Name: file.Path[len(file.Path)-1],
-				Size: file.Length,
-				Type: getFileExtension(file.Path[len(file.Path)-1]),
-				Path: fullPath,
+				Index:    i,
+				Name:     file.Path[len(file.Path)-1],
+				Size:     file.Length,
+				Type:     getFileExtension(file.Path[len(file.Path)-1]),
+				Path:     fullPath,
+				Priority: PriorityNormal,
+				Complete: fileComplete(tor, i),
 			}
 			torInfo.Files = append(torInfo.Files, fileInfo)
 
@@ -139,54 +147,255 @@ func GetTorrentInfo(tor *torrent.Torrent) (*TorrentInfo, error) {
 
 // GetPeerInfo extracts peer connection information
 func GetPeerInfo(tor *torrent.Torrent) []PeerInfo {
+	return getPeerInfo(tor, nil, nil, nil)
+}
+
+// getPeerInfo fills in per peer rates from est when one is tracking tor
+func getPeerInfo(tor *torrent.Torrent, est *RateEstimator, geo *GeoIP, bans *banList) []PeerInfo {
 	var peers []PeerInfo
 	stats := tor.Stats()
 
+	numPieces := 0
+	if tor.Info() != nil {
+		numPieces = tor.NumPieces()
+	}
+
 	activePeers := tor.PeerConns()
-	activeMap := make(map[string]bool)
+	activeMap := make(map[string]*torrent.PeerConn)
 	for _, ap := range activePeers {
 		if ap.RemoteAddr != nil {
-			activeMap[ap.RemoteAddr.String()] = true
+			activeMap[ap.RemoteAddr.String()] = ap
 		}
 	}
 
+	swarm := tor.KnownSwarm()
+	encrypted := connEncryption(swarm, activeMap)
+
 	// THIS SHIT IS SO ASS I DONT UNDERSTAND SHIT, ACCORDING TO DOCUMENTATION KnownSwarm returns "KNOWN subset of peers (active, inactive, half-open, full-open) THOUGH IT DOESNT MAKE SENSE HOW IT WORKS"
-	for _, peer := range tor.KnownSwarm() {
+	for _, peer := range swarm {
 		if peer.Addr != nil {
 			addr := peer.Addr.String()
-			peers = append(peers, PeerInfo{
+			pc, active := activeMap[addr]
+			info := PeerInfo{
 				Address: addr,
-				Active:  activeMap[addr],
+				Active:  active,
 				Stats: PeerStats{
 					TotalPeers:   stats.TotalPeers,
 					ActivePeers:  stats.ActivePeers,
 					PendingPeers: stats.PendingPeers,
 				},
-			})
+				Source:      peerSourceName(peer.Source),
+				PeerChoking: true,
+			}
+			if peer.Id != ([20]byte{}) {
+				info.PeerID = fmt.Sprintf("%x", peer.Id[:])
+				info.Client = DecodePeerID(peer.Id)
+			}
+			if ap, err := netip.ParseAddrPort(addr); err == nil {
+				info.Country = geo.Country(ap.Addr())
+				info.HashFails = bans.hashFails(ap.Addr())
+				if ban, ok := bans.reason(ap.Addr()); ok {
+					info.Banned = ban.Reason
+				}
+			}
+			if active {
+				fillConnInfo(&info, pc, numPieces)
+				info.Encryption = "plain"
+				if encrypted[addr] {
+					info.Encryption = "encrypted"
+				}
+				if est != nil {
+					info.DownloadRate, info.UploadRate = est.PeerRates(pc)
+				}
+			}
+			peers = append(peers, info)
 		}
 	}
 
 	return peers
 }
 
-// GetProgressInfo calculates current download progress
-func GetProgressInfo(tor *torrent.Torrent, startTime time.Time) ProgressInfo {
+// connEncryption tells which active connections negotiated an encrypted
+// header. anacrolix keeps that state private but lists every connection
+// last in KnownSwarm, with SupportsEncryption set from it.
+func connEncryption(swarm []torrent.PeerInfo, active map[string]*torrent.PeerConn) map[string]bool {
+	encrypted := make(map[string]bool)
+	for _, peer := range swarm {
+		if peer.Addr == nil {
+			continue
+		}
+		if addr := peer.Addr.String(); active[addr] != nil {
+			encrypted[addr] = peer.SupportsEncryption
+		}
+	}
+	return encrypted
+}
+
+// fillConnInfo adds what is only known about a peer while connected to it
+func fillConnInfo(info *PeerInfo, pc *torrent.PeerConn, numPieces int) {
+	if pc.PeerID != ([20]byte{}) {
+		info.PeerID = fmt.Sprintf("%x", pc.PeerID[:])
+	}
+	info.Client = peerClientName(pc)
+	info.Network = peerNetworkName(pc)
+	info.Incoming = pc.Discovery == torrent.PeerSourceIncoming
+	info.Source = peerSourceName(pc.Discovery)
+	info.PeerChoking, info.PeerInterested = peerFlags(pc)
+	if numPieces > 0 {
+		info.Progress = float64(pc.PeerPieces().GetCardinality()) / float64(numPieces) * 100
+	}
+}
+
+// GetProgressInfo calculates current download progress. Speeds and ETA come
+// from est when given, otherwise from the payload received since startTime.
+func GetProgressInfo(tor *torrent.Torrent, startTime time.Time, est *RateEstimator) ProgressInfo {
 	completed := tor.BytesCompleted()
 	total := tor.Length()
 	elapsed := time.Since(startTime).Seconds()
-	speed := float64(completed) / elapsed
 
-	var eta float64
-	if speed > 0 {
+	var rates Rates
+	if est != nil {
+		rates = est.Sample(tor)
+	} else if elapsed > 0 {
+		stats := tor.Stats()
+		rates.Download = float64(stats.BytesReadData.Int64()) / elapsed
+		rates.Upload = float64(stats.BytesWrittenData.Int64()) / elapsed
+	}
+	speed := rates.Download
+
+	eta := -1.0
+	if completed == total {
+		eta = 0
+	} else if speed > 0 {
 		eta = float64(total-completed) / speed
 	}
 
+	percentage := 0.0
+	if total > 0 {
+		percentage = float64(completed) * 100 / float64(total)
+	}
+
 	return ProgressInfo{
-		Completed:   completed,
-		Total:       total,
-		Percentage:  float64(completed) * 100 / float64(total),
-		Speed:       speed,
-		TimeElapsed: elapsed,
-		ETA:         eta,
+		Completed:    completed,
+		Total:        total,
+		Percentage:   percentage,
+		Speed:        speed,
+		TimeElapsed:  elapsed,
+		ETA:          eta,
+		Rates:        rates,
+		Files:        GetFileProgress(tor),
+		Pieces:       GetPieceMap(tor),
+		Availability: GetPieceAvailability(tor),
+	}
+}
+
+// fileComplete reports whether file i of tor has every byte
+func fileComplete(tor *torrent.Torrent, i int) bool {
+	files := tor.Files()
+	return i < len(files) && files[i].BytesCompleted() == files[i].Length()
+}
+
+// GetFileProgress reports the bytes completed for every file
+func GetFileProgress(tor *torrent.Torrent) []FileProgress {
+	if tor.Info() == nil {
+		return nil
+	}
+
+	files := tor.Files()
+	progress := make([]FileProgress, len(files))
+	for i, f := range files {
+		done := f.BytesCompleted()
+		percentage := 100.0
+		if f.Length() > 0 {
+			percentage = float64(done) * 100 / float64(f.Length())
+		}
+		progress[i] = FileProgress{
+			Index:      i,
+			Path:       f.DisplayPath(),
+			Completed:  done,
+			Size:       f.Length(),
+			Percentage: percentage,
+			Complete:   done == f.Length(),
+		}
+	}
+	return progress
+}
+
+// GetPieceMap captures the status of every piece
+func GetPieceMap(tor *torrent.Torrent) PieceMap {
+	if tor.Info() == nil {
+		return PieceMap{}
+	}
+
+	m := newPieceMap(tor.NumPieces())
+	i := 0
+	for _, run := range tor.PieceStateRuns() {
+		status := PieceMissing
+		switch {
+		case run.Checking || run.Hashing || run.QueuedForHash:
+			status = PieceChecking
+		case run.Complete:
+			status = PieceHave
+		case run.Partial:
+			status = PiecePartial
+		}
+		for j := 0; j < run.Length; j++ {
+			m.set(i, status)
+			i++
+		}
+	}
+	return m
+}
+
+// GetPieceAvailability counts the connected peers that have each piece
+func GetPieceAvailability(tor *torrent.Torrent) []int {
+	if tor.Info() == nil {
+		return nil
+	}
+
+	counts := make([]int, tor.NumPieces())
+	for _, pc := range tor.PeerConns() {
+		it := pc.PeerPieces().Iterator()
+		for it.HasNext() {
+			if i := int(it.Next()); i < len(counts) {
+				counts[i]++
+			}
+		}
+	}
+	return counts
+}
+
+func newPieceMap(n int) PieceMap {
+	return PieceMap{n: n, bits: make([]byte, (n+3)/4)}
+}
+
+func (m PieceMap) set(i int, s PieceStatus) {
+	shift := uint(i%4) * 2
+	m.bits[i/4] = m.bits[i/4]&^(3<<shift) | byte(s)<<shift
+}
+
+// Len returns the number of pieces in the map
+func (m PieceMap) Len() int {
+	return m.n
+}
+
+// At returns the status of piece i
+func (m PieceMap) At(i int) PieceStatus {
+	shift := uint(i%4) * 2
+	return PieceStatus(m.bits[i/4]>>shift) & 3
+}
+
+// Bytes returns the packed map, four pieces per byte with the first piece in the low bits
+func (m PieceMap) Bytes() []byte {
+	return append([]byte(nil), m.bits...)
+}
+
+// String renders one character per piece: '#' have, '+' partial, '?' checking, '.' missing
+func (m PieceMap) String() string {
+	var sb strings.Builder
+	sb.Grow(m.n)
+	for i := 0; i < m.n; i++ {
+		sb.WriteByte(".+#?"[m.At(i)])
 	}
+	return sb.String()
 }
@@ -0,0 +1,135 @@
+package torrent
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// verifyPieces rehashes every piece of tor against the data on disk, calling
+// progress after each one, and returns the number of pieces that are complete.
+// anacrolix verifies one piece per call, so several run side by side.
+func verifyPieces(tor *torrent.Torrent, progress func(done, total int)) int {
+	total := tor.NumPieces()
+	pieces := make(chan int)
+	var (
+		mu   sync.Mutex
+		done int
+		wg   sync.WaitGroup
+	)
+
+	// VerifyData returns with the hash result, a passing piece is marked
+	// complete in storage right after. Every piece state change wakes the
+	// workers waiting for that.
+	changes := tor.SubscribePieceStateChanges()
+	defer changes.Close()
+	var marking sync.Mutex
+	marked := sync.NewCond(&marking)
+	go func() {
+		for range changes.Values {
+			marking.Lock()
+			marked.Broadcast()
+			marking.Unlock()
+		}
+	}()
+
+	workers := runtime.NumCPU()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pieces {
+				tor.Piece(i).VerifyData()
+				marking.Lock()
+				for tor.Piece(i).State().Marking {
+					marked.Wait()
+				}
+				marking.Unlock()
+				mu.Lock()
+				done++
+				if progress != nil {
+					progress(done, total)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < total; i++ {
+		pieces <- i
+	}
+	close(pieces)
+	wg.Wait()
+
+	complete := 0
+	for i := 0; i < total; i++ {
+		if tor.Piece(i).State().Complete {
+			complete++
+		}
+	}
+	return complete
+}
+
+// Recheck rehashes every piece against the data in storage and returns how
+// many pieces that were complete turned out bad. Bad pieces are downloaded
+// again. Transfers are held while checking, see CheckProgress.
+func (h *Handle) Recheck() (int, error) {
+	if h.tor.Info() == nil {
+		return 0, fmt.Errorf("torrent %s has no metadata yet", h.InfoHash())
+	}
+
+	h.mu.Lock()
+	if h.checking || h.moving {
+		h.mu.Unlock()
+		return 0, fmt.Errorf("torrent %s is busy", h.InfoHash())
+	}
+	h.checking = true
+	h.checkDone, h.checkTotal = 0, h.tor.NumPieces()
+	h.mu.Unlock()
+	h.updateTransfer()
+
+	had := make([]bool, h.tor.NumPieces())
+	for i := range had {
+		had[i] = h.tor.Piece(i).State().Complete
+	}
+	verifyPieces(h.tor, func(done, total int) {
+		h.mu.Lock()
+		h.checkDone = done
+		h.mu.Unlock()
+	})
+	bad := 0
+	for i, ok := range had {
+		if ok && !h.tor.Piece(i).State().Complete {
+			bad++
+		}
+	}
+
+	h.mu.Lock()
+	h.checking = false
+	// A finished torrent with bad pieces downloads again
+	restart := !h.completedAt.IsZero() && !h.seedOnly && !filesComplete(h.tor, h.priorities)
+	if restart {
+		h.completedAt = time.Time{}
+	}
+	h.mu.Unlock()
+	h.updateTransfer()
+
+	if restart {
+		go h.watchPieces()
+	}
+	h.session.updateQueue()
+	return bad, h.save()
+}
+
+// CheckProgress returns the pieces hashed so far by a running check and
+// the number to hash, zero totals when no check is running
+func (h *Handle) CheckProgress() (done, total int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.checking {
+		return 0, 0
+	}
+	return h.checkDone, h.checkTotal
+}
@@ -0,0 +1,326 @@
+package torrent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	bencode "github.com/serene-brew/ztorrent/bencode"
+)
+
+const (
+	// watchSettle is how long a file must go unmodified before it is read,
+	// so files still being written are left alone
+	watchSettle = 2 * time.Second
+	// addedSuffix and invalidSuffix mark processed files left in place
+	addedSuffix   = ".added"
+	invalidSuffix = ".invalid"
+)
+
+// WatchDir adds every .torrent file, and every .magnet or .txt file of
+// magnet links, that appears in Path. Processed files are moved to MoveTo
+// or, without one, renamed with an ".added" suffix. Files that do not parse
+// get an ".invalid" suffix instead, except .txt files without any magnet
+// link, which are left alone. Files that fail for any other reason, like a
+// torrent the session could not add, are tried again on the next poll.
+type WatchDir struct {
+	Path     string   `json:"path"`
+	SavePath string   `json:"save_path"` // empty uses the session default
+	Labels   []string `json:"labels"`
+	Paused   bool     `json:"paused"`
+	MoveTo   string   `json:"move_to"` // relative paths are inside Path
+}
+
+// Validate rejects a watch directory without a path
+func (w WatchDir) Validate() error {
+	if w.Path == "" {
+		return fmt.Errorf("watch directory path cannot be empty")
+	}
+	return nil
+}
+
+// moveTo returns the directory processed files go to, empty to rename them in place
+func (w WatchDir) moveTo() string {
+	if w.MoveTo == "" || filepath.IsAbs(w.MoveTo) {
+		return w.MoveTo
+	}
+	return filepath.Join(w.Path, w.MoveTo)
+}
+
+// watchKind tells what a file in a watch directory holds, empty to ignore it
+func watchKind(name string) string {
+	if strings.HasPrefix(name, ".") {
+		return ""
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".torrent":
+		return "torrent"
+	case ".magnet":
+		return "magnet"
+	case ".txt":
+		return "text"
+	}
+	return ""
+}
+
+// watchedFile is the last stat of a file waiting to settle
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	// done marks a processed file that could not be moved away
+	done bool
+}
+
+// watchDirLoop polls the watch directories until the session closes
+func (s *Session) watchDirLoop() {
+	defer s.wg.Done()
+	every := time.Duration(s.config.WatchIntervalSeconds) * time.Second
+	if every <= 0 {
+		every = 5 * time.Second
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	seen := make(map[string]watchedFile)
+	for {
+		for _, w := range s.config.WatchDirs {
+			s.scanWatchDir(w, seen)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// scanWatchDir processes the files of w that have settled. A file is
+// settled once two polls in a row see the same size and modification time
+// and it was last modified watchSettle ago.
+func (s *Session) scanWatchDir(w WatchDir, seen map[string]watchedFile) {
+	entries, err := os.ReadDir(w.Path)
+	if err != nil {
+		s.logf("watch %s: %v", w.Path, err)
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		kind := watchKind(entry.Name())
+		if kind == "" || !entry.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(w.Path, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		current := watchedFile{size: info.Size(), modTime: info.ModTime()}
+		last, ok := seen[path]
+		if ok && last.done && last.size == current.size && last.modTime.Equal(current.modTime) {
+			continue
+		}
+		seen[path] = current
+		if !ok || last != current || now.Sub(current.modTime) < watchSettle {
+			continue
+		}
+		delete(seen, path)
+
+		suffix, added := addedSuffix, true
+		err = s.addWatched(w, path, kind)
+		switch {
+		case kind == "text" && errors.Is(err, errNoMagnets):
+			// Any other text file, not ours to rename
+			current.done = true
+			seen[path] = current
+			continue
+		case errors.As(err, new(invalidWatchError)):
+			s.logf("watch %s: %v", path, err)
+			suffix, added = invalidSuffix, false
+		case err != nil:
+			// Still settled, so the next poll tries it again
+			s.logf("watch %s: %v", path, err)
+			seen[path] = current
+			continue
+		}
+		if !s.finishWatched(w, path, suffix, added) {
+			// Left in place, so skip it until it changes
+			current.done = true
+			seen[path] = current
+		}
+	}
+
+	// Forget files that went away, settled or left in place
+	for path := range seen {
+		if filepath.Dir(path) != filepath.Clean(w.Path) {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			delete(seen, path)
+		}
+	}
+}
+
+// invalidWatchError is a watched file that does not parse, as opposed to
+// one whose torrents could not be added right now
+type invalidWatchError struct {
+	err error
+}
+
+func (e invalidWatchError) Error() string { return e.err.Error() }
+func (e invalidWatchError) Unwrap() error { return e.err }
+
+// addWatched adds the torrents held by the file at path
+func (s *Session) addWatched(w WatchDir, path, kind string) error {
+	opts := AddOptions{SavePath: w.SavePath, Labels: w.Labels, Paused: w.Paused}
+
+	if kind == "torrent" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if _, err := bencode.ParseTorrent(data); err != nil {
+			return invalidWatchError{fmt.Errorf("invalid torrent file: %v", err)}
+		}
+		h, err := s.AddTorrentFile(path, opts)
+		if err != nil {
+			return err
+		}
+		s.logf("watch %s: added %s", path, h.Name())
+		return nil
+	}
+
+	magnets, err := readMagnetFile(path)
+	if err != nil {
+		return err
+	}
+	parsed, added := 0, 0
+	var addErr error
+	for _, uri := range magnets {
+		if _, err := bencode.ParseMagnetLink(uri); err != nil {
+			s.logf("watch %s: skipping %q: %v", path, uri, err)
+			continue
+		}
+		parsed++
+		h, err := s.AddMagnet(uri, opts)
+		if err != nil {
+			s.logf("watch %s: %v", path, err)
+			addErr = err
+			continue
+		}
+		s.logf("watch %s: added %s", path, h.Name())
+		added++
+	}
+	switch {
+	case parsed == 0:
+		return invalidWatchError{fmt.Errorf("no valid magnet link")}
+	case added == 0:
+		return fmt.Errorf("no magnet link could be added: %v", addErr)
+	}
+	return nil
+}
+
+var errNoMagnets = errors.New("no magnet links found")
+
+// readMagnetFile returns the magnet links of a text file, one per line
+func readMagnetFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var magnets []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "magnet:?") {
+			magnets = append(magnets, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(magnets) == 0 {
+		return nil, invalidWatchError{errNoMagnets}
+	}
+	return magnets, nil
+}
+
+// finishWatched moves a processed file out of the way so it is not added
+// again, to the move_to directory when added or set, renamed with suffix
+// otherwise. It reports false when the file could not be moved and stays.
+func (s *Session) finishWatched(w WatchDir, path, suffix string, added bool) bool {
+	target := path + suffix
+	if dir := w.moveTo(); dir != "" && added {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			s.logf("watch %s: %v", path, err)
+		} else {
+			target = filepath.Join(dir, filepath.Base(path))
+		}
+	}
+	if err := moveFile(path, uniquePath(target)); err != nil {
+		s.logf("watch %s: %v", path, err)
+		return false
+	}
+	return true
+}
+
+// moveFile renames src to dst, copying it when they are on different
+// filesystems. src is only removed once dst holds all of it.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("failed to copy to %s: %v", dst, err)
+	}
+	if err := os.Remove(src); err != nil {
+		// Both copies stay, dst is what counts as processed
+		return fmt.Errorf("copied to %s but failed to remove the original: %v", dst, err)
+	}
+	return nil
+}
+
+// uniquePath appends a number to path until nothing exists there
+func uniquePath(path string) string {
+	candidate := path
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = path + "." + strconv.Itoa(i)
+	}
+}